@@ -0,0 +1,343 @@
+// Package backup implements the backup archives of the issuer storage.  An
+// archive is a gzipped tar with a manifest.json entry followed by a data
+// entry with all the key values of the storage.
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+const (
+	entryManifest = "manifest.json"
+	entryData     = "data"
+	// restoreBatch is the number of key values written in each storage
+	// transaction by Restore.
+	restoreBatch = 1024
+	// maxRecordLen is the maximum length of a key or value in the data
+	// entry.
+	maxRecordLen = 64 * 1024 * 1024
+)
+
+// IdentityState is the state of an identity of a backup archive.
+type IdentityState struct {
+	Id    core.ID          `json:"id"`
+	State *merkletree.Hash `json:"state"`
+}
+
+// Manifest describes the contents of a backup archive.  Id and State are the
+// ones of the main identity, and Identities has the states of all the
+// identities of the archive, the main one included.  Checksums has the hex
+// encoded sha256 of the archive entries.
+type Manifest struct {
+	Id            core.ID           `json:"id"`
+	State         *merkletree.Hash  `json:"state"`
+	Identities    []IdentityState   `json:"identities,omitempty"`
+	SchemaVersion int               `json:"schemaVersion"`
+	Created       time.Time         `json:"created"`
+	Keys          int               `json:"keys"`
+	Checksums     map[string]string `json:"checksums"`
+}
+
+// FileName returns the default file name of the archive.
+func (m *Manifest) FileName() string {
+	return fmt.Sprintf("issuer-%v-%v.tar.gz", m.Id.String(), m.Created.UTC().Format("20060102T150405Z"))
+}
+
+// Snapshot is a copy of the key values of a storage in a temporary file, from
+// which an archive can be written after the storage is released.
+type Snapshot struct {
+	file     *os.File
+	size     int64
+	keys     int
+	checksum string
+}
+
+// NewSnapshot copies all the key values of storage into a Snapshot.
+func NewSnapshot(storage db.Storage) (*Snapshot, error) {
+	file, err := ioutil.TempFile("", "issuer-backup-")
+	if err != nil {
+		return nil, err
+	}
+	s := &Snapshot{file: file}
+	hasher := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(file, hasher))
+	if err := storage.Iterate(func(k, v []byte) (bool, error) {
+		s.keys++
+		return true, writeRecord(w, k, v)
+	}); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := w.Flush(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if s.size, err = file.Seek(0, io.SeekCurrent); err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.checksum = hex.EncodeToString(hasher.Sum(nil))
+	return s, nil
+}
+
+// Close removes the temporary file of the snapshot.
+func (s *Snapshot) Close() error {
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// File is an extra file of an archive, written after the data entry.
+type File struct {
+	Name string
+	Data []byte
+}
+
+// WriteArchive writes the archive of the snapshot with the extra files to w.
+// The Keys and Checksums of the manifest are set from the snapshot and the
+// files.
+func (s *Snapshot) WriteArchive(w io.Writer, manifest *Manifest, files ...File) error {
+	manifest.Keys = s.keys
+	manifest.Checksums = map[string]string{entryData: s.checksum}
+	for _, file := range files {
+		if file.Name == entryManifest || file.Name == entryData {
+			return fmt.Errorf("Reserved archive file name %v", file.Name)
+		}
+		checksum := sha256.Sum256(file.Data)
+		manifest.Checksums[file.Name] = hex.EncodeToString(checksum[:])
+	}
+	manifestJSON, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	if err := tw.WriteHeader(&tar.Header{Name: entryManifest, Mode: 0600,
+		Size: int64(len(manifestJSON)), ModTime: manifest.Created}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(manifestJSON); err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: entryData, Mode: 0600,
+		Size: s.size, ModTime: manifest.Created}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(tw, s.file); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: file.Name, Mode: 0600,
+			Size: int64(len(file.Data)), ModTime: manifest.Created}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.Data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// Reader reads a backup archive.
+type Reader struct {
+	gr       *gzip.Reader
+	tr       *tar.Reader
+	Manifest Manifest
+}
+
+// NewReader opens the archive read from r and reads its manifest.
+func NewReader(r io.Reader) (*Reader, error) {
+	gr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid backup archive: %w", err)
+	}
+	br := &Reader{gr: gr, tr: tar.NewReader(gr)}
+	if err := br.next(entryManifest); err != nil {
+		return nil, err
+	}
+	if err := json.NewDecoder(br.tr).Decode(&br.Manifest); err != nil {
+		return nil, fmt.Errorf("Invalid backup manifest: %w", err)
+	}
+	return br, nil
+}
+
+func (br *Reader) next(name string) error {
+	header, err := br.tr.Next()
+	if err != nil {
+		return fmt.Errorf("Invalid backup archive, reading %v: %w", name, err)
+	}
+	if header.Name != name {
+		return fmt.Errorf("Invalid backup archive: found %v, expected %v", header.Name, name)
+	}
+	return nil
+}
+
+// Iterate calls f with every key value of the archive and verifies them
+// against the manifest once all have been read.
+func (br *Reader) Iterate(f func(k, v []byte) error) error {
+	if err := br.next(entryData); err != nil {
+		return err
+	}
+	hasher := sha256.New()
+	r := bufio.NewReader(io.TeeReader(br.tr, hasher))
+	keys := 0
+	for {
+		k, v, err := readRecord(r)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("Invalid backup data: %w", err)
+		}
+		if err := f(k, v); err != nil {
+			return err
+		}
+		keys++
+	}
+	return br.verify(hasher, keys)
+}
+
+func (br *Reader) verify(hasher hash.Hash, keys int) error {
+	if checksum := hex.EncodeToString(hasher.Sum(nil)); checksum != br.Manifest.Checksums[entryData] {
+		return fmt.Errorf("Backup data checksum mismatch: %v, manifest has %v",
+			checksum, br.Manifest.Checksums[entryData])
+	}
+	if keys != br.Manifest.Keys {
+		return fmt.Errorf("Backup data has %v keys, manifest has %v", keys, br.Manifest.Keys)
+	}
+	return nil
+}
+
+// Files reads the extra files of the archive, after Iterate or Restore, and
+// verifies them against the manifest.
+func (br *Reader) Files() (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	for {
+		header, err := br.tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("Invalid backup archive: %w", err)
+		}
+		checksum, ok := br.Manifest.Checksums[header.Name]
+		if !ok || header.Name == entryData {
+			return nil, fmt.Errorf("Unexpected backup archive file %v", header.Name)
+		}
+		hasher := sha256.New()
+		data, err := ioutil.ReadAll(io.TeeReader(br.tr, hasher))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid backup archive, reading %v: %w", header.Name, err)
+		}
+		if hex.EncodeToString(hasher.Sum(nil)) != checksum {
+			return nil, fmt.Errorf("Backup file %v checksum mismatch", header.Name)
+		}
+		files[header.Name] = data
+	}
+	for name := range br.Manifest.Checksums {
+		if _, ok := files[name]; !ok && name != entryData {
+			return nil, fmt.Errorf("Missing backup archive file %v", name)
+		}
+	}
+	return files, nil
+}
+
+// Verify reads the whole archive from r, verifying its entries against the
+// manifest and the gzip checksum, and returns the manifest.
+func Verify(r io.Reader) (*Manifest, error) {
+	br, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := br.Iterate(func(k, v []byte) error { return nil }); err != nil {
+		return nil, err
+	}
+	if _, err := br.Files(); err != nil {
+		return nil, err
+	}
+	// The gzip checksum is verified at the end of the stream
+	if _, err := io.Copy(ioutil.Discard, br.gr); err != nil {
+		return nil, fmt.Errorf("Invalid backup archive: %w", err)
+	}
+	return &br.Manifest, nil
+}
+
+// Restore writes the key values of the archive into storage.  The data is
+// verified against the manifest, so storage must be discarded if an error is
+// returned.
+func (br *Reader) Restore(storage db.Storage) error {
+	tx, err := storage.NewTx()
+	if err != nil {
+		return err
+	}
+	n := 0
+	if err := br.Iterate(func(k, v []byte) error {
+		tx.Put(k, v)
+		if n++; n%restoreBatch == 0 {
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+			if tx, err = storage.NewTx(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		tx.Close()
+		return err
+	}
+	return tx.Commit()
+}
+
+func writeRecord(w io.Writer, k, v []byte) error {
+	var buf [binary.MaxVarintLen64]byte
+	for _, b := range [][]byte{k, v} {
+		if _, err := w.Write(buf[:binary.PutUvarint(buf[:], uint64(len(b)))]); err != nil {
+			return err
+		}
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readRecord(r *bufio.Reader) ([]byte, []byte, error) {
+	var kv [2][]byte
+	for i := range kv {
+		l, err := binary.ReadUvarint(r)
+		if err == io.EOF && i == 0 {
+			return nil, nil, io.EOF
+		} else if err != nil {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		if l > maxRecordLen {
+			return nil, nil, fmt.Errorf("record length %v too big", l)
+		}
+		kv[i] = make([]byte, l)
+		if _, err := io.ReadFull(r, kv[i]); err != nil {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+	}
+	return kv[0], kv[1], nil
+}
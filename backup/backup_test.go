@@ -0,0 +1,86 @@
+package backup
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupRestore(t *testing.T) {
+	storage := db.NewMemoryStorage()
+	tx, err := storage.NewTx()
+	require.Nil(t, err)
+	for i := 0; i < restoreBatch+10; i++ {
+		tx.Put([]byte(fmt.Sprintf("k%06d", i)), bytes.Repeat([]byte{byte(i)}, i%64))
+	}
+	require.Nil(t, tx.Commit())
+
+	snapshot, err := NewSnapshot(storage)
+	require.Nil(t, err)
+	defer snapshot.Close()
+	id, err := core.IDFromString("117D1GdPubM5NrwTH2Da44SMQFndg87m6kwVQTswLZ")
+	require.Nil(t, err)
+	manifest := &Manifest{Id: id, State: &merkletree.HashZero, SchemaVersion: 1, Created: time.Now()}
+	var archive bytes.Buffer
+	require.Nil(t, snapshot.WriteArchive(&archive, manifest, File{"extra", []byte("data")}))
+	require.Equal(t, restoreBatch+10, manifest.Keys)
+
+	br, err := NewReader(bytes.NewReader(archive.Bytes()))
+	require.Nil(t, err)
+	require.Equal(t, manifest.Checksums, br.Manifest.Checksums)
+	require.Equal(t, id, br.Manifest.Id)
+	restored := db.NewMemoryStorage()
+	require.Nil(t, br.Restore(restored))
+	kvs, err := storage.List(0)
+	require.Nil(t, err)
+	kvsRestored, err := restored.List(0)
+	require.Nil(t, err)
+	require.Equal(t, kvs, kvsRestored)
+	files, err := br.Files()
+	require.Nil(t, err)
+	require.Equal(t, map[string][]byte{"extra": []byte("data")}, files)
+
+	// A manifest that doesn't match the data is detected
+	manifest.Checksums = nil
+	manifest.Keys = 0
+	archive.Reset()
+	snapshot.keys++
+	require.Nil(t, snapshot.WriteArchive(&archive, manifest))
+	br, err = NewReader(bytes.NewReader(archive.Bytes()))
+	require.Nil(t, err)
+	require.Error(t, br.Restore(db.NewMemoryStorage()))
+}
+
+func TestVerify(t *testing.T) {
+	storage := db.NewMemoryStorage()
+	tx, err := storage.NewTx()
+	require.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		tx.Put([]byte(fmt.Sprintf("k%06d", i)), bytes.Repeat([]byte{byte(i)}, 1024))
+	}
+	require.Nil(t, tx.Commit())
+	snapshot, err := NewSnapshot(storage)
+	require.Nil(t, err)
+	defer snapshot.Close()
+	id, err := core.IDFromString("117D1GdPubM5NrwTH2Da44SMQFndg87m6kwVQTswLZ")
+	require.Nil(t, err)
+	manifest := &Manifest{Id: id, State: &merkletree.HashZero, SchemaVersion: 1, Created: time.Now()}
+	var archive bytes.Buffer
+	require.Nil(t, snapshot.WriteArchive(&archive, manifest, File{"extra", []byte("data")}))
+
+	verified, err := Verify(bytes.NewReader(archive.Bytes()))
+	require.Nil(t, err)
+	require.Equal(t, manifest.Checksums, verified.Checksums)
+
+	// Truncated anywhere, up to the gzip trailer
+	for _, n := range []int{archive.Len() / 2, archive.Len() - 100, archive.Len() - 1} {
+		_, err = Verify(bytes.NewReader(archive.Bytes()[:n]))
+		require.Error(t, err, n)
+	}
+}
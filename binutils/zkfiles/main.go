@@ -22,12 +22,32 @@ func main() {
 				zkutils.ProvingKeyFormatBin, zkutils.ProvingKeyFormatGoBin)},
 	}
 
+	hashFlags := []cli.Flag{
+		cli.StringFlag{Name: "hashes", Usage: "file with the expected hashes, " +
+			"the output of hash or an issuer config"},
+		cli.StringFlag{Name: "proving-key-hash", Usage: "expected proving key hash"},
+		cli.StringFlag{Name: "verification-key-hash", Usage: "expected verification key hash"},
+		cli.StringFlag{Name: "witness-calc-wasm-hash", Usage: "expected witness calculator hash"},
+	}
+
+	downloadFlags := append([]cli.Flag{
+		cli.BoolFlag{Name: "unverified", Usage: "allow files without expected hash, which are not verified"},
+		cli.StringSliceFlag{Name: "mirror", Usage: "base url tried after url, http(s):// or file://"},
+	}, hashFlags...)
+
 	app.Commands = []cli.Command{
 		{
 			Name:   "download",
-			Usage:  "Download the zk files from the url into path",
+			Usage:  "Download the zk files from the url or mirrors into path, resuming partial downloads",
+			Flags:  downloadFlags,
 			Action: cmd.CmdDownloadZKFiles,
 		},
+		{
+			Name:   "check",
+			Usage:  "Check the hashes of the zk files in path, failing on mismatch",
+			Flags:  hashFlags,
+			Action: cmd.CmdCheckZKFiles,
+		},
 		{
 			Name:   "hash",
 			Usage:  "Hash the zk files from the path",
@@ -36,6 +56,7 @@ func main() {
 		{
 			Name:  "downloadhash",
 			Usage: "Download the zk files from url into path and hash them",
+			Flags: downloadFlags,
 			Action: func(c *cli.Context) error {
 				if err := cmd.CmdDownloadZKFiles(c); err != nil {
 					return err
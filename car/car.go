@@ -0,0 +1,424 @@
+// Package car reads and writes CAR (content addressable archive) v1 files,
+// and implements the archive of the identity data as an IPLD DAG.  Only
+// CIDv1 with sha2-256 multihashes are supported.
+package car
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Multicodec codes.
+const (
+	CodecRaw     = 0x55
+	CodecDagCbor = 0x71
+	mhSha256     = 0x12
+)
+
+// maxSectionLen is the maximum length of a CAR section.
+const maxSectionLen = 32 * 1024 * 1024
+
+var base32Lower = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// Cid is a binary CIDv1.
+type Cid string
+
+// NewCid returns the CIDv1 of data with the codec.
+func NewCid(codec uint64, data []byte) Cid {
+	digest := sha256.Sum256(data)
+	b := make([]byte, 0, 4+len(digest))
+	b = appendUvarint(b, 1)
+	b = appendUvarint(b, codec)
+	b = appendUvarint(b, mhSha256)
+	b = appendUvarint(b, uint64(len(digest)))
+	return Cid(append(b, digest[:]...))
+}
+
+// String returns the base32 multibase encoding of the CID.
+func (c Cid) String() string {
+	return "b" + strings.ToLower(base32Lower.EncodeToString([]byte(c)))
+}
+
+// Codec returns the codec of the CID.
+func (c Cid) Codec() uint64 {
+	_, n := binary.Uvarint([]byte(c))
+	codec, _ := binary.Uvarint([]byte(c)[n:])
+	return codec
+}
+
+// readCid reads a CID from the start of b and returns its length.
+func readCid(b []byte) (Cid, int, error) {
+	n := 0
+	var fields [4]uint64
+	for i := range fields {
+		v, l := binary.Uvarint(b[n:])
+		if l <= 0 || l != len(appendUvarint(nil, v)) {
+			return "", 0, fmt.Errorf("invalid cid")
+		}
+		fields[i] = v
+		n += l
+	}
+	if fields[0] != 1 {
+		return "", 0, fmt.Errorf("unsupported cid version %v", fields[0])
+	}
+	if fields[2] != mhSha256 || fields[3] != sha256.Size {
+		return "", 0, fmt.Errorf("unsupported multihash %#x", fields[2])
+	}
+	if len(b) < n+sha256.Size {
+		return "", 0, fmt.Errorf("invalid cid")
+	}
+	n += sha256.Size
+	return Cid(b[:n]), n, nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// Writer writes a CAR file.
+type Writer struct {
+	w *bufio.Writer
+}
+
+// NewWriter writes the CAR header with the roots to w and returns a Writer
+// for its blocks.
+func NewWriter(w io.Writer, roots ...Cid) (*Writer, error) {
+	links := make([]interface{}, len(roots))
+	for i, root := range roots {
+		links[i] = root
+	}
+	header, err := encodeCbor(map[string]interface{}{"roots": links, "version": uint64(1)})
+	if err != nil {
+		return nil, err
+	}
+	cw := &Writer{w: bufio.NewWriter(w)}
+	if err := cw.writeSection(header); err != nil {
+		return nil, err
+	}
+	return cw, nil
+}
+
+func (cw *Writer) writeSection(parts ...[]byte) error {
+	l := 0
+	for _, part := range parts {
+		l += len(part)
+	}
+	if _, err := cw.w.Write(appendUvarint(nil, uint64(l))); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if _, err := cw.w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Put writes the block data with the CID c.
+func (cw *Writer) Put(c Cid, data []byte) error {
+	return cw.writeSection([]byte(c), data)
+}
+
+// Flush writes the buffered blocks to the underlying writer.
+func (cw *Writer) Flush() error {
+	return cw.w.Flush()
+}
+
+// Reader reads a CAR file.
+type Reader struct {
+	r     *bufio.Reader
+	Roots []Cid
+}
+
+// NewReader reads the CAR header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	cr := &Reader{r: bufio.NewReader(r)}
+	section, err := cr.readSection()
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CAR header: %w", err)
+	}
+	v, err := decodeCbor(section)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid CAR header: %w", err)
+	}
+	header, ok := v.(map[string]interface{})
+	if !ok || header["version"] != uint64(1) {
+		return nil, fmt.Errorf("Unsupported CAR header")
+	}
+	roots, _ := header["roots"].([]interface{})
+	for _, root := range roots {
+		c, ok := root.(Cid)
+		if !ok {
+			return nil, fmt.Errorf("Invalid CAR header root")
+		}
+		cr.Roots = append(cr.Roots, c)
+	}
+	return cr, nil
+}
+
+func (cr *Reader) readSection() ([]byte, error) {
+	l, err := binary.ReadUvarint(cr.r)
+	if err != nil {
+		return nil, err
+	}
+	if l > maxSectionLen {
+		return nil, fmt.Errorf("section length %v too big", l)
+	}
+	section := make([]byte, l)
+	if _, err := io.ReadFull(cr.r, section); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return section, nil
+}
+
+// Next returns the next block, after verifying its CID.  At the end of the
+// file io.EOF is returned.
+func (cr *Reader) Next() (Cid, []byte, error) {
+	section, err := cr.readSection()
+	if errors.Is(err, io.EOF) {
+		return "", nil, io.EOF
+	} else if err != nil {
+		return "", nil, fmt.Errorf("Invalid CAR block: %w", err)
+	}
+	c, n, err := readCid(section)
+	if err != nil {
+		return "", nil, fmt.Errorf("Invalid CAR block: %w", err)
+	}
+	data := section[n:]
+	if expected := NewCid(c.Codec(), data); c != expected {
+		return "", nil, fmt.Errorf("CAR block %v doesn't match its data, expected %v", c, expected)
+	}
+	return c, data, nil
+}
+
+// encodeCbor encodes v as DAG-CBOR.  v can be made of uint64, []byte,
+// string, Cid (encoded as a link), []interface{} and map[string]interface{}.
+func encodeCbor(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeCbor(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCborHead(buf *bytes.Buffer, major byte, n uint64) {
+	switch {
+	case n < 24:
+		buf.WriteByte(major<<5 | byte(n))
+	case n <= 0xff:
+		buf.Write([]byte{major<<5 | 24, byte(n)})
+	case n <= 0xffff:
+		buf.WriteByte(major<<5 | 25)
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	case n <= 0xffffffff:
+		buf.WriteByte(major<<5 | 26)
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	default:
+		buf.WriteByte(major<<5 | 27)
+		binary.Write(buf, binary.BigEndian, n)
+	}
+}
+
+func writeCbor(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case uint64:
+		writeCborHead(buf, 0, v)
+	case []byte:
+		writeCborHead(buf, 2, uint64(len(v)))
+		buf.Write(v)
+	case string:
+		writeCborHead(buf, 3, uint64(len(v)))
+		buf.WriteString(v)
+	case Cid:
+		// Links are tag 42 with the binary CID prefixed by the identity
+		// multibase
+		writeCborHead(buf, 6, 42)
+		writeCborHead(buf, 2, uint64(len(v)+1))
+		buf.WriteByte(0)
+		buf.WriteString(string(v))
+	case []interface{}:
+		writeCborHead(buf, 4, uint64(len(v)))
+		for _, e := range v {
+			if err := writeCbor(buf, e); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		// DAG-CBOR sorts the map keys by length and then bytewise
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return cborKeyLess(keys[i], keys[j]) })
+		writeCborHead(buf, 5, uint64(len(v)))
+		for _, k := range keys {
+			if err := writeCbor(buf, k); err != nil {
+				return err
+			}
+			if err := writeCbor(buf, v[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported cbor type %T", v)
+	}
+	return nil
+}
+
+// cborKeyLess returns true if the map key a is sorted before b: DAG-CBOR
+// sorts the map keys by length and then bytewise.
+func cborKeyLess(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) < len(b)
+	}
+	return a < b
+}
+
+// decodeCbor decodes the DAG-CBOR data encoded by encodeCbor.  Only the
+// canonical encoding is accepted, so that every value has a single CID.
+func decodeCbor(data []byte) (interface{}, error) {
+	r := bytes.NewReader(data)
+	v, err := readCbor(r, 0)
+	if err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("trailing cbor data")
+	}
+	return v, nil
+}
+
+const maxCborDepth = 16
+
+func readCborHead(r *bytes.Reader) (byte, uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	major, info := b>>5, b&0x1f
+	if info < 24 {
+		return major, uint64(info), nil
+	}
+	var size int
+	switch info {
+	case 24:
+		size = 1
+	case 25:
+		size = 2
+	case 26:
+		size = 4
+	case 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("unsupported cbor additional info %v", info)
+	}
+	var n uint64
+	for i := 0; i < size; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		n = n<<8 | uint64(b)
+	}
+	// The shortest head must be used
+	if size == 1 && n < 24 || size > 1 && n < 1<<(8*uint(size)/2) {
+		return 0, 0, fmt.Errorf("non-canonical cbor head")
+	}
+	return major, n, nil
+}
+
+func readCbor(r *bytes.Reader, depth int) (interface{}, error) {
+	if depth > maxCborDepth {
+		return nil, fmt.Errorf("cbor too deep")
+	}
+	major, n, err := readCborHead(r)
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case 0:
+		return n, nil
+	case 2, 3:
+		if n > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if major == 3 {
+			if !utf8.Valid(b) {
+				return nil, fmt.Errorf("invalid utf-8 cbor string")
+			}
+			return string(b), nil
+		}
+		return b, nil
+	case 4:
+		if n > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		a := make([]interface{}, n)
+		for i := range a {
+			if a[i], err = readCbor(r, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return a, nil
+	case 5:
+		if n > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		m := make(map[string]interface{}, n)
+		var last string
+		for i := uint64(0); i < n; i++ {
+			k, err := readCbor(r, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			ks, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("cbor map key is not a string")
+			}
+			if i > 0 && !cborKeyLess(last, ks) {
+				return nil, fmt.Errorf("cbor map keys are not sorted or duplicated")
+			}
+			last = ks
+			if m[ks], err = readCbor(r, depth+1); err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case 6:
+		if n != 42 {
+			return nil, fmt.Errorf("unsupported cbor tag %v", n)
+		}
+		v, err := readCbor(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		b, ok := v.([]byte)
+		if !ok || len(b) < 1 || b[0] != 0 {
+			return nil, fmt.Errorf("invalid cbor link")
+		}
+		c, l, err := readCid(b[1:])
+		if err != nil {
+			return nil, err
+		}
+		if l != len(b)-1 {
+			return nil, fmt.Errorf("invalid cbor link")
+		}
+		return c, nil
+	default:
+		return nil, fmt.Errorf("unsupported cbor major type %v", major)
+	}
+}
@@ -0,0 +1,145 @@
+package car
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCid(t *testing.T) {
+	require.Equal(t, "bafkreifzjut3te2nhyekklss27nh3k72ysco7y32koao5eei66wof36n5e",
+		NewCid(CodecRaw, []byte("hello world")).String())
+}
+
+func TestCborNonCanonical(t *testing.T) {
+	c := NewCid(CodecRaw, []byte("hello world"))
+	canonical, err := encodeCbor(map[string]interface{}{"a": uint64(1), "bb": "x", "l": c})
+	require.Nil(t, err)
+	_, err = decodeCbor(canonical)
+	require.Nil(t, err)
+
+	for _, data := range []string{
+		"1801",       // 1 with a 1-byte head
+		"190001",     // 1 with a 2-byte head
+		"1a000000ff", // 255 with a 4-byte head
+		"1b00000000ffffffff",
+		"780161",         // "a" with a 1-byte length
+		"a2616101616101", // duplicated key
+		"a2626262016161", // keys not sorted by length
+		"a2616201616101", // keys not sorted bytewise
+		"61ff",           // invalid utf-8
+		// link with a non-minimal cid version varint
+		"d82a5826008100" + hex.EncodeToString([]byte(c)[1:]),
+	} {
+		b, err := hex.DecodeString(data)
+		require.Nil(t, err)
+		_, err = decodeCbor(b)
+		require.Error(t, err, data)
+	}
+
+	_, err = encodeCbor(map[string]interface{}{"a": 1})
+	require.Error(t, err)
+}
+
+// goCarFixture is a CAR v1 written by go-car v2.13.1 (blockstore.OpenReadWrite
+// with WriteAsCarV1), with a DAG-CBOR root block encoded by go-ipld-prime that
+// links to a raw block.
+const goCarFixture = "" +
+	"3aa265726f6f747381d82a582500017112200257fd8d0e667fcb904e53aa4012" +
+	"bae813557266df375d63aafeb6f48b2019da6776657273696f6e017201711220" +
+	"0257fd8d0e667fcb904e53aa4012bae813557266df375d63aafeb6f48b2019da" +
+	"a462696443010203646e616d656766697874757265656c696e6b7381d82a5825" +
+	"0001551220b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7" +
+	"ace2efcde96776657273696f6e012f01551220b94d27b9934d3e08a52e52d7da" +
+	"7dabfac484efe37a5380ee9088f7ace2efcde968656c6c6f20776f726c64"
+
+func TestGoCarFixture(t *testing.T) {
+	fixture, err := hex.DecodeString(goCarFixture)
+	require.Nil(t, err)
+	rawCid := NewCid(CodecRaw, []byte("hello world"))
+	rootData, err := encodeCbor(map[string]interface{}{
+		"id":      []byte{1, 2, 3},
+		"name":    "fixture",
+		"links":   []interface{}{rawCid},
+		"version": uint64(1),
+	})
+	require.Nil(t, err)
+	rootCid := NewCid(CodecDagCbor, rootData)
+	require.Equal(t, "bafyreiack76y2dtgp7fzatstvjabfoxicnkxezw7g5owhkx6w32iwiaz3i", rootCid.String())
+
+	// Written byte by byte like go-car
+	var buf bytes.Buffer
+	cw, err := NewWriter(&buf, rootCid)
+	require.Nil(t, err)
+	require.Nil(t, cw.Put(rootCid, rootData))
+	require.Nil(t, cw.Put(rawCid, []byte("hello world")))
+	require.Nil(t, cw.Flush())
+	require.Equal(t, fixture, buf.Bytes())
+
+	// Read like go-car wrote it
+	cr, err := NewReader(bytes.NewReader(fixture))
+	require.Nil(t, err)
+	require.Equal(t, []Cid{rootCid}, cr.Roots)
+	c, data, err := cr.Next()
+	require.Nil(t, err)
+	require.Equal(t, rootCid, c)
+	v, err := decodeCbor(data)
+	require.Nil(t, err)
+	require.Equal(t, []interface{}{rawCid}, v.(map[string]interface{})["links"])
+	c, data, err = cr.Next()
+	require.Nil(t, err)
+	require.Equal(t, rawCid, c)
+	require.Equal(t, []byte("hello world"), data)
+	_, _, err = cr.Next()
+	require.Equal(t, io.EOF, err)
+}
+
+func TestIdentityExportImport(t *testing.T) {
+	storage := db.NewMemoryStorage()
+	tx, err := storage.NewTx()
+	require.Nil(t, err)
+	for i := 0; i < 3*fanout; i++ {
+		tx.Put([]byte(fmt.Sprintf("k%06d", i)), bytes.Repeat([]byte{byte(i)}, i%64))
+	}
+	require.Nil(t, tx.Commit())
+	id, err := core.IDFromString("117D1GdPubM5NrwTH2Da44SMQFndg87m6kwVQTswLZ")
+	require.Nil(t, err)
+	state := &merkletree.Hash{1, 2, 3}
+	iden := &Identity{Id: id, State: state}
+
+	var archive bytes.Buffer
+	root, err := ExportIdentity(&archive, storage, iden)
+	require.Nil(t, err)
+	require.Equal(t, 3*fanout, iden.Keys)
+
+	imported := db.NewMemoryStorage()
+	tx, err = imported.NewTx()
+	require.Nil(t, err)
+	idenImported, rootImported, err := ImportIdentity(bytes.NewReader(archive.Bytes()),
+		func(k, v []byte) error {
+			tx.Put(k, v)
+			return nil
+		})
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+	require.Equal(t, root, rootImported)
+	require.Equal(t, iden, idenImported)
+	kvs, err := storage.List(0)
+	require.Nil(t, err)
+	kvsImported, err := imported.List(0)
+	require.Nil(t, err)
+	require.Equal(t, kvs, kvsImported)
+
+	// A modified block is detected
+	data := archive.Bytes()
+	data[len(data)-1] ^= 1
+	_, _, err = ImportIdentity(bytes.NewReader(data), func(k, v []byte) error { return nil })
+	require.Error(t, err)
+}
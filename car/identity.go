@@ -0,0 +1,245 @@
+package car
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// fanout is the maximum number of links of the root and index blocks.
+const fanout = 1024
+
+// maxDepth is the maximum depth of the index blocks.
+const maxDepth = 8
+
+type block struct {
+	cid  Cid
+	data []byte
+}
+
+// Identity is the root of an identity archive.  The root block is a
+// DAG-CBOR map with the identity id, its state, the number of keys and the
+// links to the blocks of the key values, so the root CID is derived from
+// the identity state and all its data.  Every key value is a raw block,
+// linked from the root through DAG-CBOR index blocks of up to 1024 links.
+type Identity struct {
+	Id    core.ID
+	State *merkletree.Hash
+	Keys  int
+}
+
+// ExportIdentity writes the archive of the key values of idenStorage, the
+// storage of the identity iden, to w and returns its root CID.  idenStorage
+// is iterated twice and must not change during the export.
+func ExportIdentity(w io.Writer, idenStorage db.Storage, iden *Identity) (Cid, error) {
+	var level []interface{}
+	if err := idenStorage.Iterate(func(k, v []byte) (bool, error) {
+		level = append(level, NewCid(CodecRaw, record(k, v)))
+		return true, nil
+	}); err != nil {
+		return "", err
+	}
+	cids := level
+	iden.Keys = len(cids)
+
+	var indexBlocks []block
+	for len(level) > fanout {
+		var next []interface{}
+		for i := 0; i < len(level); i += fanout {
+			end := i + fanout
+			if end > len(level) {
+				end = len(level)
+			}
+			data, err := encodeCbor(level[i:end])
+			if err != nil {
+				return "", err
+			}
+			c := NewCid(CodecDagCbor, data)
+			indexBlocks = append(indexBlocks, block{c, data})
+			next = append(next, c)
+		}
+		level = next
+	}
+	if level == nil {
+		level = []interface{}{}
+	}
+	rootData, err := encodeCbor(map[string]interface{}{
+		"id":      iden.Id[:],
+		"state":   iden.State[:],
+		"keys":    uint64(iden.Keys),
+		"links":   level,
+		"version": uint64(1),
+	})
+	if err != nil {
+		return "", err
+	}
+	root := NewCid(CodecDagCbor, rootData)
+
+	cw, err := NewWriter(w, root)
+	if err != nil {
+		return "", err
+	}
+	if err := cw.Put(root, rootData); err != nil {
+		return "", err
+	}
+	for i := len(indexBlocks) - 1; i >= 0; i-- {
+		if err := cw.Put(indexBlocks[i].cid, indexBlocks[i].data); err != nil {
+			return "", err
+		}
+	}
+	n := 0
+	if err := idenStorage.Iterate(func(k, v []byte) (bool, error) {
+		data := record(k, v)
+		c := NewCid(CodecRaw, data)
+		if n >= len(cids) || c != cids[n] {
+			return false, fmt.Errorf("Storage changed during the export")
+		}
+		n++
+		return true, cw.Put(c, data)
+	}); err != nil {
+		return "", err
+	}
+	if n != len(cids) {
+		return "", fmt.Errorf("Storage changed during the export")
+	}
+	return root, cw.Flush()
+}
+
+// ImportIdentity reads the identity archive from r, verifying the CIDs of all
+// its blocks, and calls f with every key value in the order they were
+// exported.  The identity and the root CID of the archive are returned.
+func ImportIdentity(r io.Reader, f func(k, v []byte) error) (*Identity, Cid, error) {
+	cr, err := NewReader(r)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(cr.Roots) != 1 {
+		return nil, "", fmt.Errorf("Identity archive has %v roots, expected 1", len(cr.Roots))
+	}
+	root := cr.Roots[0]
+	blocks := make(map[Cid][]byte)
+	for {
+		c, data, err := cr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		blocks[c] = data
+	}
+
+	rootData, ok := blocks[root]
+	if !ok || root.Codec() != CodecDagCbor {
+		return nil, "", fmt.Errorf("Missing root block %v", root)
+	}
+	v, err := decodeCbor(rootData)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid root block: %w", err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok || m["version"] != uint64(1) {
+		return nil, "", fmt.Errorf("Unsupported root block")
+	}
+	idBytes, _ := m["id"].([]byte)
+	stateBytes, _ := m["state"].([]byte)
+	keys, okKeys := m["keys"].(uint64)
+	links, okLinks := m["links"].([]interface{})
+	if !okKeys || !okLinks || len(stateBytes) != merkletree.ElemBytesLen {
+		return nil, "", fmt.Errorf("Invalid root block")
+	}
+	id, err := core.IDFromBytes(idBytes)
+	if err != nil {
+		return nil, "", fmt.Errorf("Invalid root block identity: %w", err)
+	}
+	iden := &Identity{Id: id, State: &merkletree.Hash{}, Keys: int(keys)}
+	copy(iden.State[:], stateBytes)
+
+	n := 0
+	visited := map[Cid]bool{root: true}
+	var walk func(links []interface{}, depth int) error
+	walk = func(links []interface{}, depth int) error {
+		if depth > maxDepth {
+			return fmt.Errorf("Identity archive too deep")
+		}
+		for _, link := range links {
+			c, ok := link.(Cid)
+			if !ok {
+				return fmt.Errorf("Invalid link %v", link)
+			}
+			data, ok := blocks[c]
+			if !ok {
+				return fmt.Errorf("Missing block %v", c)
+			}
+			if visited[c] {
+				return fmt.Errorf("Block %v linked twice", c)
+			}
+			visited[c] = true
+			switch c.Codec() {
+			case CodecRaw:
+				k, v, err := parseRecord(data)
+				if err != nil {
+					return fmt.Errorf("Invalid block %v: %w", c, err)
+				}
+				if err := f(k, v); err != nil {
+					return err
+				}
+				n++
+			case CodecDagCbor:
+				v, err := decodeCbor(data)
+				if err != nil {
+					return fmt.Errorf("Invalid block %v: %w", c, err)
+				}
+				index, ok := v.([]interface{})
+				if !ok {
+					return fmt.Errorf("Invalid index block %v", c)
+				}
+				if err := walk(index, depth+1); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("Unsupported block codec %#x", c.Codec())
+			}
+		}
+		return nil
+	}
+	if err := walk(links, 0); err != nil {
+		return nil, "", err
+	}
+	if n != iden.Keys {
+		return nil, "", fmt.Errorf("Identity archive has %v keys, root block has %v", n, iden.Keys)
+	}
+	if len(visited) != len(blocks) {
+		return nil, "", fmt.Errorf("Identity archive has %v blocks not linked from the root",
+			len(blocks)-len(visited))
+	}
+	return iden, root, nil
+}
+
+// record encodes the key value k, v as the data of a raw block.
+func record(k, v []byte) []byte {
+	b := make([]byte, 0, 2*binary.MaxVarintLen64+len(k)+len(v))
+	b = appendUvarint(b, uint64(len(k)))
+	b = append(b, k...)
+	b = appendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+func parseRecord(b []byte) ([]byte, []byte, error) {
+	var kv [2][]byte
+	for i := range kv {
+		l, n := binary.Uvarint(b)
+		if n <= 0 || l > uint64(len(b)-n) {
+			return nil, nil, fmt.Errorf("invalid record")
+		}
+		kv[i], b = b[n:n+int(l)], b[n+int(l):]
+	}
+	if len(b) != 0 {
+		return nil, nil, fmt.Errorf("invalid record")
+	}
+	return kv[0], kv[1], nil
+}
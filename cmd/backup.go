@@ -0,0 +1,209 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-servers/backup"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/iden3/go-iden3-servers/loaders"
+	"github.com/iden3/go-iden3-servers/storage"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+// CmdDbBackup writes a backup archive of the storage to the file given as
+// argument.  If the storage is locked by a running server, the backup is
+// requested to its admin api.
+func CmdDbBackup(c *cli.Context, cfg *config.Config) error {
+	path := c.Args().Get(0)
+	if path == "" {
+		return fmt.Errorf("Missing backup file argument")
+	}
+	if err := writeBackupFile(path, func(w io.Writer) error {
+		sto, err := loaders.LoadStorageReadOnly(&cfg.Storage)
+		if errors.Is(err, storage.ErrLocked) {
+			log.Info("Storage locked by running server, requesting the backup to the admin api")
+			return backupAdminApi(&cfg.Server, w)
+		} else if err != nil {
+			return err
+		}
+		defer sto.Close()
+		return backupStorage(sto, cfg, w)
+	}); err != nil {
+		return err
+	}
+	fmt.Printf("Backup written to %v\n", path)
+	return nil
+}
+
+// writeFileAtomic writes the file at path with write, through a temporary
+// file that is renamed once written.
+func writeFileAtomic(path string, write func(w io.Writer) error) error {
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer file.Close()
+	if err := write(file); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// writeBackupFile writes the backup archive at path with write, verifying it
+// while it's written, so that an archive cut short, like one streamed by the
+// admin api after its status was sent, is never renamed into place.
+func writeBackupFile(path string, write func(w io.Writer) error) error {
+	return writeFileAtomic(path, func(w io.Writer) error {
+		pr, pw := io.Pipe()
+		verified := make(chan error)
+		go func() {
+			_, err := backup.Verify(pr)
+			// Drain the rest of the archive if it's invalid
+			io.Copy(ioutil.Discard, pr) //nolint:errcheck
+			verified <- err
+		}()
+		err := write(io.MultiWriter(w, pw))
+		pw.CloseWithError(err)
+		if errVerify := <-verified; err == nil && errVerify != nil {
+			err = fmt.Errorf("Error verifying backup archive: %w", errVerify)
+		}
+		return err
+	})
+}
+
+func backupStorage(sto db.Storage, cfg *config.Config, w io.Writer) error {
+	cfgIdens, err := loaders.LoadAllHostedIdentities(cfg, sto)
+	if err != nil {
+		return err
+	}
+	ids := make([]core.ID, len(cfgIdens))
+	for i := range cfgIdens {
+		ids[i] = cfgIdens[i].Id
+	}
+	states, err := loaders.IdentityStates(sto, ids)
+	if err != nil {
+		return err
+	}
+	version, err := loaders.LoadSchemaVersion(sto)
+	if err != nil {
+		return err
+	}
+	manifest := &backup.Manifest{
+		Id:            cfg.Identity.Id,
+		State:         states[0].State,
+		Identities:    states,
+		SchemaVersion: version,
+		Created:       time.Now(),
+	}
+	snapshot, err := backup.NewSnapshot(sto)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+	if err := snapshot.WriteArchive(w, manifest); err != nil {
+		return err
+	}
+	log.WithField("keys", manifest.Keys).WithField("state", manifest.State).
+		WithField("identities", len(manifest.Identities)).Info("Backup done")
+	return nil
+}
+
+func backupAdminApi(cfgServer *config.Server, w io.Writer) error {
+	res, err := http.Post(fmt.Sprintf("http://%s/api/unstable/backup", cfgServer.AdminApi), "", nil)
+	if err != nil {
+		return fmt.Errorf("Failed http request: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed http request: %v", res.Status)
+	}
+	_, err = io.Copy(w, res.Body)
+	return err
+}
+
+// CmdDbRestore replaces the storage with the contents of the backup archive
+// given as argument.  The archive is restored into a new storage and verified
+// against its manifest before the current storage is moved aside.
+func CmdDbRestore(c *cli.Context, cfg *config.Config) error {
+	path := c.Args().Get(0)
+	if path == "" {
+		return fmt.Errorf("Missing backup file argument")
+	}
+	if cfg.Storage.Type == loaders.StorageTypeMemory {
+		return fmt.Errorf("Can't restore into a %v storage", cfg.Storage.Type)
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	br, err := backup.NewReader(file)
+	if err != nil {
+		return err
+	}
+	manifest := &br.Manifest
+	if manifest.Id != cfg.Identity.Id {
+		return fmt.Errorf("Backup is of identity %v, but the configured one is %v",
+			manifest.Id, cfg.Identity.Id)
+	}
+	if manifest.SchemaVersion > loaders.SchemaVersion {
+		return fmt.Errorf("Backup schema version %v is newer than the supported %v",
+			manifest.SchemaVersion, loaders.SchemaVersion)
+	}
+
+	// Fail early if the server is running
+	if _, err := os.Stat(cfg.Storage.Path); err == nil {
+		sto, err := loaders.LoadStorage(&cfg.Storage)
+		if err != nil {
+			return err
+		}
+		sto.Close()
+	}
+
+	cfgRestore := cfg.Storage
+	cfgRestore.Path = cfg.Storage.Path + ".restore"
+	if err := os.RemoveAll(cfgRestore.Path); err != nil {
+		return err
+	}
+	sto, err := loaders.LoadStorage(&cfgRestore)
+	if err != nil {
+		return err
+	}
+	err = br.Restore(sto)
+	if err == nil {
+		err = loaders.CheckIdentityStates(sto, manifest)
+	}
+	sto.Close()
+	if err != nil {
+		os.RemoveAll(cfgRestore.Path)
+		return fmt.Errorf("Error restoring backup: %w", err)
+	}
+
+	if _, err := os.Stat(cfg.Storage.Path); err == nil {
+		oldPath := fmt.Sprintf("%v.pre-restore-%v", cfg.Storage.Path, time.Now().Unix())
+		if err := os.Rename(cfg.Storage.Path, oldPath); err != nil {
+			return err
+		}
+		fmt.Printf("Previous storage moved to %v\n", oldPath)
+	}
+	if err := os.Rename(cfgRestore.Path, cfg.Storage.Path); err != nil {
+		return err
+	}
+	fmt.Printf("Restored %v keys of identity %v with state %v from %v\n",
+		manifest.Keys, manifest.Id, manifest.State, path)
+	return nil
+}
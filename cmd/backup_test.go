@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/iden3/go-iden3-servers/backup"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupAdminApiTruncated(t *testing.T) {
+	storage := db.NewMemoryStorage()
+	tx, err := storage.NewTx()
+	require.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		tx.Put([]byte{byte(i)}, bytes.Repeat([]byte{byte(i)}, 1024))
+	}
+	require.Nil(t, tx.Commit())
+	snapshot, err := backup.NewSnapshot(storage)
+	require.Nil(t, err)
+	defer snapshot.Close()
+	id, err := core.IDFromString("117D1GdPubM5NrwTH2Da44SMQFndg87m6kwVQTswLZ")
+	require.Nil(t, err)
+	var archive bytes.Buffer
+	require.Nil(t, snapshot.WriteArchive(&archive, &backup.Manifest{Id: id,
+		State: &merkletree.HashZero, Created: time.Now()}))
+
+	// The server fails after sending the status and part of the archive
+	size := archive.Len()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(archive.Bytes()[:size]) //nolint:errcheck
+	}))
+	defer server.Close()
+	cfgServer := &config.Server{AdminApi: strings.TrimPrefix(server.URL, "http://")}
+
+	dir, err := ioutil.TempDir("", "backup")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup.tar.gz")
+	write := func(w io.Writer) error { return backupAdminApi(cfgServer, w) }
+	require.Nil(t, writeBackupFile(path, write))
+	require.Nil(t, os.Remove(path))
+
+	for _, size = range []int{archive.Len() / 2, archive.Len() - 1} {
+		err = writeBackupFile(path, write)
+		require.Error(t, err)
+		_, err = os.Stat(path)
+		require.True(t, os.IsNotExist(err))
+		_, err = os.Stat(path + ".tmp")
+		require.True(t, os.IsNotExist(err))
+	}
+}
@@ -0,0 +1,127 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-servers/car"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/iden3/go-iden3-servers/loaders"
+	"github.com/urfave/cli"
+)
+
+// CmdDbExportCar writes the key values of the identity, the configured one or
+// the one given by the --id flag, to the CAR file given as argument.
+func CmdDbExportCar(c *cli.Context, cfg *config.Config) error {
+	path := c.Args().Get(0)
+	if path == "" {
+		return fmt.Errorf("Missing CAR file argument")
+	}
+	id := cfg.Identity.Id
+	if c.String("id") != "" {
+		var err error
+		if id, err = core.IDFromString(c.String("id")); err != nil {
+			return fmt.Errorf("Invalid identity: %w", err)
+		}
+	}
+	storage, err := loaders.LoadStorageReadOnly(&cfg.Storage)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	idenStorage := loaders.IdenStorage(storage, &id)
+	state, err := loaders.LoadIdenState(idenStorage)
+	if err != nil {
+		return err
+	}
+
+	iden := &car.Identity{Id: id, State: state}
+	var root car.Cid
+	if err := writeFileAtomic(path, func(w io.Writer) error {
+		root, err = car.ExportIdentity(w, idenStorage, iden)
+		return err
+	}); err != nil {
+		return err
+	}
+	fmt.Printf("Exported %v keys of identity %v with state %v to %v\nroot cid: %v\n",
+		iden.Keys, &id, state.Hex(), path, root)
+	return nil
+}
+
+// CmdDbImportCar imports the identity archived in the CAR file given as
+// argument into the storage.  The CIDs of the archive and the identity state
+// are verified before writing, and the identity must not be in the storage.
+func CmdDbImportCar(c *cli.Context, cfgStorage *config.Storage) error {
+	path := c.Args().Get(0)
+	if path == "" {
+		return fmt.Errorf("Missing CAR file argument")
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	memStorage := db.NewMemoryStorage()
+	tx, err := memStorage.NewTx()
+	if err != nil {
+		return err
+	}
+	iden, root, err := car.ImportIdentity(file, func(k, v []byte) error {
+		tx.Put(k, v)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	state, err := loaders.LoadIdenState(memStorage)
+	if err != nil {
+		return err
+	}
+	if !state.Equals(iden.State) {
+		return fmt.Errorf("Imported state %v doesn't match the archive state %v",
+			state.Hex(), iden.State.Hex())
+	}
+
+	storage, err := loaders.LoadStorage(cfgStorage)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	idenStorage := loaders.IdenStorage(storage, &iden.Id)
+	exists := false
+	if err := idenStorage.Iterate(func(k, v []byte) (bool, error) {
+		exists = true
+		return false, nil
+	}); err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("Identity %v already in storage", &iden.Id)
+	}
+	if err := loaders.InitSchemaVersion(storage); err != nil {
+		return err
+	}
+	if tx, err = idenStorage.NewTx(); err != nil {
+		return err
+	}
+	if err := memStorage.Iterate(func(k, v []byte) (bool, error) {
+		tx.Put(k, v)
+		return true, nil
+	}); err != nil {
+		tx.Close()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	fmt.Printf("Imported %v keys of identity %v with state %v from %v\nroot cid: %v\n",
+		iden.Keys, &iden.Id, state.Hex(), path, root)
+	return nil
+}
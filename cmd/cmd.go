@@ -3,26 +3,31 @@ package cmd
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"math/big"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethclient"
 	common3 "github.com/iden3/go-iden3-core/common"
 	"github.com/iden3/go-iden3-core/components/idenpubonchain"
 	"github.com/iden3/go-iden3-core/db"
-	"github.com/iden3/go-iden3-core/identity/issuer"
 	babykeystore "github.com/iden3/go-iden3-core/keystore"
 	zkutils "github.com/iden3/go-iden3-core/utils/zk"
+	"github.com/iden3/go-iden3-crypto/babyjub"
 	"github.com/iden3/go-iden3-servers/config"
 	"github.com/iden3/go-iden3-servers/loaders"
-	shell "github.com/ipfs/go-ipfs-api"
+	"github.com/iden3/go-iden3-servers/zkfiles"
 	log "github.com/sirupsen/logrus"
 	"github.com/urfave/cli"
 )
@@ -155,22 +160,37 @@ func WithCfg(cmd func(c *cli.Context, cfg *config.Config) error) func(c *cli.Con
 // }
 
 // DB
-func CmdDbRawDump(c *cli.Context, storagePath string) error {
-	storage, err := loaders.LoadStorage(storagePath)
+func CmdDbRawDump(c *cli.Context, cfgStorage *config.Storage) error {
+	storage, err := loaders.LoadStorageReadOnly(cfgStorage)
 	if err != nil {
 		return err
 	}
-	ldb := (storage.(*db.LevelDbStorage)).LevelDB()
-	iter := ldb.NewIterator(nil, nil)
-	for iter.Next() {
-		fmt.Println(common3.HexEncode(iter.Key()) + ", " + common3.HexEncode(iter.Value()))
-	}
-	iter.Release()
-	return nil
+	defer storage.Close()
+	return storage.Iterate(func(k, v []byte) (bool, error) {
+		fmt.Println(rawDumpLine(k, v))
+		return true, nil
+	})
 }
 
-func CmdDbRawImport(c *cli.Context, storagePath string) error {
+// rawDumpLine returns the line of a key value in the rawdump format.
+func rawDumpLine(k, v []byte) string {
+	return common3.HexEncode(k) + ", " + common3.HexEncode(v)
+}
+
+// CmdDbRawImport imports a rawdump file into the storage in a single
+// transaction.  The whole file is validated before anything is written, and
+// keys that already exist with a different value are only overwritten with
+// --force.  A sha256 of the imported key values in rawdump format, sorted by
+// key, is reported so that it can be compared with a dump of the storage.
+func CmdDbRawImport(c *cli.Context, cfgStorage *config.Storage) error {
 	path := c.Args().Get(0)
+	if path == "" {
+		return fmt.Errorf("Missing rawdump file argument")
+	}
+	prefix := []byte(c.String("prefix"))
+	dryRun := c.Bool("dry-run")
+	force := c.Bool("force")
+
 	file, err := os.Open(path)
 	if err != nil {
 		return err
@@ -179,131 +199,206 @@ func CmdDbRawImport(c *cli.Context, storagePath string) error {
 
 	fmt.Println("importing raw dump from file " + path)
 
-	count := 0
+	kvs := make(map[string][]byte)
+	lines, skipped := 0, 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		lines++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		line := strings.Split(scanner.Text(), ", ")
+		if len(line) != 2 {
+			return fmt.Errorf("Invalid line %v: expected \"<hex key>, <hex value>\"", lines)
+		}
+		k, err := common3.HexDecode(line[0])
+		if err != nil {
+			return fmt.Errorf("Invalid key in line %v: %w", lines, err)
+		}
+		v, err := common3.HexDecode(line[1])
+		if err != nil {
+			return fmt.Errorf("Invalid value in line %v: %w", lines, err)
+		}
+		if !bytes.HasPrefix(k, prefix) {
+			skipped++
+			continue
+		}
+		if prev, ok := kvs[string(k)]; ok && !bytes.Equal(prev, v) {
+			return fmt.Errorf("Key %v in line %v is duplicated with a different value",
+				line[0], lines)
+		}
+		kvs[string(k)] = v
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("Error reading line %v: %w", lines+1, err)
+	}
 
-	storage, err := loaders.LoadStorage(storagePath)
+	load := loaders.LoadStorage
+	if dryRun {
+		load = loaders.LoadStorageReadOnly
+	}
+	storage, err := load(cfgStorage)
 	if err != nil {
 		return err
 	}
+	defer storage.Close()
+
+	keys := make([]string, 0, len(kvs))
+	for k := range kvs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
 	tx, err := storage.NewTx()
 	if err != nil {
 		return err
 	}
-
-	defer func() {
+	defer tx.Close()
+	hasher := sha256.New()
+	unchanged, overwritten, conflicts := 0, 0, 0
+	for _, k := range keys {
+		v := kvs[k]
+		fmt.Fprintln(hasher, rawDumpLine([]byte(k), v))
+		prev, err := storage.Get([]byte(k))
 		if err == nil {
-			tx.Commit()
-		} else {
-			tx.Close()
-		}
-	}()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.Split(scanner.Text(), ", ")
-		if len(line) < 2 {
-			fmt.Println("error in line ", strconv.Itoa(count))
+			if bytes.Equal(prev, v) {
+				unchanged++
+				continue
+			}
+			if !force {
+				conflicts++
+				if conflicts <= 10 {
+					fmt.Printf("key %v already exists with a different value\n",
+						common3.HexEncode([]byte(k)))
+				}
+				continue
+			}
+			overwritten++
+		} else if err != db.ErrNotFound {
 			return err
 		}
+		tx.Put([]byte(k), v)
+	}
+	checksum := hex.EncodeToString(hasher.Sum(nil))
 
-		var kBytes []byte
-		kBytes, err = common3.HexDecode(line[0])
-		if err != nil {
-			return err
-		}
-		var vBytes []byte
-		vBytes, err = common3.HexDecode(line[1])
+	fmt.Printf("lines: %v, keys: %v, skipped by prefix: %v, unchanged: %v, "+
+		"new: %v, overwritten: %v\n", lines, len(keys), skipped, unchanged,
+		len(keys)-unchanged-overwritten-conflicts, overwritten)
+	fmt.Println("sha256 of the imported key values: " + checksum)
+	if conflicts > 0 {
+		return fmt.Errorf("%v keys already exist with a different value, use --force to overwrite them",
+			conflicts)
+	}
+	if dryRun {
+		fmt.Println("dry run, nothing imported")
+		return nil
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Error committing import: %w", err)
+	}
+
+	// Verify the stored values
+	hasher.Reset()
+	for _, k := range keys {
+		v, err := storage.Get([]byte(k))
 		if err != nil {
-			return err
+			return fmt.Errorf("Error verifying key %v: %w", common3.HexEncode([]byte(k)), err)
 		}
-		tx.Put(kBytes, vBytes)
-		count++
+		fmt.Fprintln(hasher, rawDumpLine([]byte(k), v))
+	}
+	if storedChecksum := hex.EncodeToString(hasher.Sum(nil)); storedChecksum != checksum {
+		return fmt.Errorf("Stored key values checksum %v doesn't match the imported %v",
+			storedChecksum, checksum)
 	}
-	fmt.Println("imported " + strconv.Itoa(count) + " lines")
+	fmt.Println("imported " + strconv.Itoa(len(keys)) + " keys, checksum verified")
 	return nil
 }
 
-func CmdDbIPFSexport(c *cli.Context, storagePath string) error {
-	storage, err := loaders.LoadStorage(storagePath)
+func NewIssuer(cfgStorage *config.Storage, keyStoreBabyPath, keyStoreBabyPassword string, confirmBlocks uint64) error {
+	storage, err := loaders.LoadStorage(cfgStorage)
 	if err != nil {
 		return err
 	}
-	ldb := (storage.(*db.LevelDbStorage)).LevelDB()
-	iter := ldb.NewIterator(nil, nil)
-	for iter.Next() {
-		sh := shell.NewShell("localhost:5001") // ipfs daemon IP:Port
-		cid, err := sh.Add(bytes.NewReader(iter.Value()))
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error: %s", err)
-			os.Exit(1)
-		}
-		fmt.Println("value of key "+common3.HexEncode(iter.Key())+" added, ipfs hash: ", cid)
+	defer storage.Close()
+	configTOML, err := newIssuer(storage, babykeystore.NewFileStorage(keyStoreBabyPath),
+		babykeystore.StandardKeyStoreParams, []byte(keyStoreBabyPassword), confirmBlocks)
+	if err != nil {
+		return err
 	}
-	iter.Release()
+	fmt.Fprintf(os.Stderr, "Keys and identity created successfully."+
+		" Copy & paste the lines between '---' into the config file:\n---\n")
+	fmt.Print(string(configTOML))
+	fmt.Fprintf(os.Stderr, "---\n")
 	return nil
 }
 
-func NewIssuer(storagePath, keyStoreBabyPath, keyStoreBabyPassword string, confirmBlocks uint64) error {
-	// Open babyjub keystore
-	params := babykeystore.StandardKeyStoreParams
-	keyStoreStorage := babykeystore.NewFileStorage(keyStoreBabyPath)
+// newIssuer creates an identity with a new babyjub key kOp and returns its
+// Identity config as TOML.  The identity is only written to storage after
+// the key is in the keystore, and the key is removed from the keystore if
+// the identity can't be written, so that on any error neither is left
+// behind.
+func newIssuer(storage db.Storage, keyStoreStorage babykeystore.Storage, params babykeystore.KeyStoreParams,
+	password []byte, confirmBlocks uint64) ([]byte, error) {
 	keyStore, err := babykeystore.NewKeyStore(keyStoreStorage, params)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer keyStore.Close()
 
-	// Create babyjub keys
-	kOpComp, err := keyStore.NewKey([]byte(keyStoreBabyPassword))
-	if err = keyStore.UnlockKey(kOpComp, []byte(keyStoreBabyPassword)); err != nil {
-		return err
-	}
-
 	// Create the Issuer in a memory db and later transfer it to the storage under the identity prefix
-	memStorage := db.NewMemoryStorage()
-	cfg := issuer.ConfigDefault
-	cfg.ConfirmBlocks = confirmBlocks
-	id, err := issuer.Create(cfg, kOpComp, nil, memStorage, keyStore)
+	id, sk, tx, err := loaders.CreateIdentity(storage, confirmBlocks)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	storage, err := loaders.LoadStorage(storagePath)
-	if err != nil {
-		return err
+	defer tx.Close()
+
+	var cfg identityConfig
+	cfg.Identity.Id = *id
+	cfg.Identity.Keys.BabyJub.KOp = *sk.Public()
+	var configTOML bytes.Buffer
+	if err := toml.NewEncoder(&configTOML).Encode(&cfg); err != nil {
+		return nil, err
 	}
-	idenStorage := storage.WithPrefix([]byte(fmt.Sprintf("%v:", id)))
-	tx, err := idenStorage.NewTx()
+
+	rollback, err := importBabyKey(keyStore, keyStoreStorage, sk, password)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	memStorage.Iterate(func(k []byte, v []byte) (bool, error) {
-		tx.Put(k, v)
-		return true, nil
-	})
 	if err := tx.Commit(); err != nil {
-		return err
+		if errRollback := rollback(); errRollback != nil {
+			log.WithError(errRollback).Error("Error rolling back babyjub key import")
+		}
+		return nil, fmt.Errorf("Error storing identity: %w", err)
 	}
+	return configTOML.Bytes(), nil
+}
 
-	var config struct {
-		Identity config.Identity
+// importBabyKey imports the secret key sk into keyStore encrypted with
+// password, and returns a function that restores the previous keystore
+// storage contents, to roll back the import.
+func importBabyKey(keyStore *babykeystore.KeyStore, keyStoreStorage babykeystore.Storage,
+	sk *babyjub.PrivateKey, password []byte) (func() error, error) {
+	prev, err := keyStoreStorage.Read()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
 	}
-	config.Identity.Id = *id
-	kOp, err := kOpComp.Decompress()
+	kOp, err := keyStore.ImportKey(*sk, password)
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("Error importing babyjub key: %w", err)
 	}
-	config.Identity.Keys.BabyJub.KOp = *kOp
-
-	var configTOML bytes.Buffer
-	if err := toml.NewEncoder(&configTOML).Encode(&config); err != nil {
+	rollback := func() error {
+		if err := keyStoreStorage.Write(prev); err != nil {
+			return fmt.Errorf("Error removing babyjub key %v from keystore: %w", kOp, err)
+		}
 		return nil
 	}
-
-	fmt.Fprintf(os.Stderr, "Keys and identity created successfully."+
-		" Copy & paste the lines between '---' into the config file:\n---\n")
-	fmt.Print(configTOML.String())
-	fmt.Fprintf(os.Stderr, "---\n")
-	return nil
+	if err := keyStore.UnlockKey(kOp, password); err != nil {
+		if errRollback := rollback(); errRollback != nil {
+			log.WithError(errRollback).Error("Error rolling back babyjub key import")
+		}
+		return nil, fmt.Errorf("Error unlocking babyjub key: %w", err)
+	}
+	return rollback, nil
 }
 
 func CmdNewIssuer(c *cli.Context) error {
@@ -311,20 +406,27 @@ func CmdNewIssuer(c *cli.Context) error {
 		KeyStore     config.KeyStore  `validate:"required"`
 		KeyStoreBaby config.KeyStore  `validate:"required"`
 		Contracts    config.Contracts `validate:"required"`
-		Storage      struct {
-			Path string
-		} `validate:"required"`
-		Issuer struct {
+		Storage      config.Storage   `validate:"required"`
+		Issuer       struct {
 			ConfirmBlocks uint64 `validate:"required"`
 		}
 	}
 	if err := config.LoadFromCliFlag(c, &cfg); err != nil {
 		return err
 	}
-	return NewIssuer(cfg.Storage.Path, cfg.KeyStoreBaby.Path, cfg.KeyStoreBaby.Password.Value,
+	return NewIssuer(&cfg.Storage, cfg.KeyStoreBaby.Path, cfg.KeyStoreBaby.Password.Value,
 		cfg.Issuer.ConfirmBlocks)
 }
 
+func CmdConfigShow(c *cli.Context, cfg *config.Config) error {
+	cfgOut, err := config.Marshal(cfg.Redacted(), c.String("format"))
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(cfgOut))
+	return nil
+}
+
 func CmdStop(c *cli.Context, cfg *config.Config) error {
 	if err := PostAdminApi(&cfg.Server, "stop", nil); err != nil {
 		return err
@@ -341,30 +443,31 @@ func CmdStop(c *cli.Context, cfg *config.Config) error {
 // }
 
 func CmdSync(c *cli.Context, cfg *config.Config) error {
-	if err := PostAdminApi(&cfg.Server, "issuer/syncidenstatepublic", nil); err != nil {
+	path := "issuer/syncidenstatepublic"
+	if id := c.String("id"); id != "" {
+		path = fmt.Sprintf("identities/%v/%v", id, path)
+	}
+	if err := PostAdminApi(&cfg.Server, path, nil); err != nil {
 		return err
 	}
 	return nil
 }
 
 func CmdStart(c *cli.Context, cfg *config.Config, endpointServe func(cfg *config.Config, srv *loaders.Server)) error {
+	if c.Bool("migrate") {
+		if err := migrateStorage(cfg, false); err != nil {
+			return err
+		}
+	}
 	srv, err := loaders.LoadServer(cfg)
 	if err != nil {
 		return err
 	}
 
 	// Check for funds
-	balance, err := srv.EthClient.BalanceAt(srv.EthClient.Account().Address)
-	if err != nil {
+	if err := srv.CheckMinBalance(); err != nil {
 		return err
 	}
-	log.WithFields(log.Fields{
-		"balance": balance.String(),
-		"address": srv.EthClient.Account().Address.Hex(),
-	}).Info("Account balance retrieved")
-	if balance.Cmp(new(big.Int).SetUint64(3000000)) == -1 {
-		return fmt.Errorf("Not enough funds in the ethereum address")
-	}
 
 	srv.Start()
 
@@ -453,10 +556,17 @@ func CmdDeployState(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	ethClient, err := loaders.LoadEthClient(ks, acc, cfg.Web3.Url)
+	web3Pool, err := loaders.NewWeb3Pool(&cfg.Web3)
 	if err != nil {
 		return err
 	}
+	ethClient, err := loaders.LoadEthClient(ks, acc, web3Pool)
+	if err != nil {
+		return err
+	}
+	if _, err := web3Pool.CheckChainId(cfg.Web3.ChainId); err != nil {
+		return err
+	}
 	result, err := idenpubonchain.DeployState(ethClient, nil)
 	if err != nil {
 		return err
@@ -466,6 +576,13 @@ func CmdDeployState(c *cli.Context) error {
 		Contracts config.Contracts `validate:"required"`
 	}
 	cfgOut.Contracts.IdenStates.Address = result.State.Address
+	if err := ethClient.Call(func(c *ethclient.Client) error {
+		code, err := c.CodeAt(context.Background(), result.State.Address, nil)
+		cfgOut.Contracts.IdenStates.CodeHash = crypto.Keccak256Hash(code)
+		return err
+	}); err != nil {
+		return err
+	}
 	var cfgOutTOML bytes.Buffer
 	if err := toml.NewEncoder(&cfgOutTOML).Encode(&cfgOut); err != nil {
 		log.Error(err)
@@ -512,9 +629,16 @@ func ValidateZKFilesProvingKeyFormat(format string) (zkutils.ProvingKeyFormat, e
 	return provingKeyFormat, nil
 }
 
+// CmdDownloadZKFiles downloads the missing zk files into path from the url
+// and then the mirrors, resuming partial downloads.  The files are verified
+// against their expected hashes before moving them into place, and a file
+// without hash is an error unless --unverified is set.
 func CmdDownloadZKFiles(c *cli.Context) error {
-	url := c.GlobalString("url")
-	if url == "" {
+	sources := c.StringSlice("mirror")
+	if url := c.GlobalString("url"); url != "" {
+		sources = append([]string{url}, sources...)
+	}
+	if len(sources) == 0 {
 		return fmt.Errorf("No url specified")
 	}
 	path := c.GlobalString("path")
@@ -525,13 +649,91 @@ func CmdDownloadZKFiles(c *cli.Context) error {
 	if err != nil {
 		return err
 	}
-	zkfiles := zkutils.NewZkFiles(url, path, format, zkutils.ZkFilesHashes{}, false)
-	if err := zkfiles.InsecureDownloadAll(); err != nil {
+	hashes, err := zkFilesHashes(c)
+	if err != nil {
 		return err
 	}
+	downloader := zkfiles.NewDownloader(sources...)
+	downloader.Progress = zkfiles.LogProgress(2 * time.Second)
+	downloader.AllowUnverified = c.Bool("unverified")
+	return downloader.Download(path, zkfiles.Files(format, hashes))
+}
+
+// zkFilesHashes returns the expected hashes of the zk files from the file of
+// the --hashes flag, overridden by the hash flags.  The file can be the
+// output of the hash command or an issuer config.
+func zkFilesHashes(c *cli.Context) (*zkutils.ZkFilesHashes, error) {
+	var hashes config.ZkFilesHashes
+	if c.String("hashes") != "" {
+		var file struct {
+			config.ZkFilesHashes
+			IdenStateZKProof struct {
+				Files struct {
+					Hashes config.ZkFilesHashes
+				}
+			}
+		}
+		if _, err := toml.DecodeFile(c.String("hashes"), &file); err != nil {
+			return nil, fmt.Errorf("Error reading hashes file: %w", err)
+		}
+		hashes = file.ZkFilesHashes
+		if hashes == (config.ZkFilesHashes{}) {
+			hashes = file.IdenStateZKProof.Files.Hashes
+		}
+	}
+	for _, flag := range []struct {
+		name string
+		hash *string
+	}{
+		{"proving-key-hash", &hashes.ProvingKey},
+		{"verification-key-hash", &hashes.VerificationKey},
+		{"witness-calc-wasm-hash", &hashes.WitnessCalcWASM},
+	} {
+		if c.String(flag.name) != "" {
+			*flag.hash = c.String(flag.name)
+		}
+	}
+	return &zkutils.ZkFilesHashes{
+		ProvingKey:      hashes.ProvingKey,
+		VerificationKey: hashes.VerificationKey,
+		WitnessCalcWASM: hashes.WitnessCalcWASM,
+	}, nil
+}
+
+// checkZKFiles prints the check result of every zk file in path, and fails if
+// any of them doesn't match its hash.
+func checkZKFiles(path string, format zkutils.ProvingKeyFormat, hashes *zkutils.ZkFilesHashes) error {
+	failed := 0
+	for _, result := range zkfiles.Check(path, zkfiles.Files(format, hashes)) {
+		fmt.Println(result.String())
+		if !result.Ok() {
+			failed++
+		}
+	}
+	if failed != 0 {
+		return fmt.Errorf("%v zk files failed the check", failed)
+	}
 	return nil
 }
 
+// CmdCheckZKFiles checks the hashes of the zk files in path against the
+// expected ones, without downloading them.
+func CmdCheckZKFiles(c *cli.Context) error {
+	path := c.GlobalString("path")
+	if path == "" {
+		return fmt.Errorf("No path specified")
+	}
+	format, err := ValidateZKFilesProvingKeyFormat(c.GlobalString("format"))
+	if err != nil {
+		return err
+	}
+	hashes, err := zkFilesHashes(c)
+	if err != nil {
+		return err
+	}
+	return checkZKFiles(path, format, hashes)
+}
+
 func CmdHashZKFiles(c *cli.Context) error {
 	path := c.GlobalString("path")
 	if path == "" {
@@ -569,23 +771,3 @@ func CmdHashZKFiles(c *cli.Context) error {
 	fmt.Fprintf(os.Stderr, "---\n")
 	return nil
 }
-
-func CmdCheckZKFiles(c *cli.Context) error {
-	url := c.GlobalString("url")
-	if url == "" {
-		return fmt.Errorf("No url specified")
-	}
-	path := c.GlobalString("path")
-	if path == "" {
-		return fmt.Errorf("No path specified")
-	}
-	format, err := ValidateZKFilesProvingKeyFormat(c.GlobalString("format"))
-	if err != nil {
-		return err
-	}
-	zkfiles := zkutils.NewZkFiles(url, path, format, zkutils.ZkFilesHashes{}, false)
-	if err := zkfiles.InsecureDownloadAll(); err != nil {
-		return err
-	}
-	return nil
-}
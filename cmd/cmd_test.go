@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/db"
+	babykeystore "github.com/iden3/go-iden3-core/keystore"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/iden3/go-iden3-servers/loaders"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+)
+
+type failCommitStorage struct {
+	db.Storage
+}
+
+func (s *failCommitStorage) NewTx() (db.Tx, error) {
+	tx, err := s.Storage.NewTx()
+	return &failCommitTx{tx}, err
+}
+
+type failCommitTx struct {
+	db.Tx
+}
+
+func (tx *failCommitTx) Commit() error { return fmt.Errorf("commit failed") }
+
+type failWriteKeyStorage struct {
+	babykeystore.MemStorage
+}
+
+func (s *failWriteKeyStorage) Write(data []byte) error { return fmt.Errorf("write failed") }
+
+func storageLen(t *testing.T, storage db.Storage) int {
+	n := 0
+	require.Nil(t, storage.Iterate(func(k, v []byte) (bool, error) {
+		n++
+		return true, nil
+	}))
+	return n
+}
+
+func keyStoreKeys(t *testing.T, keyStoreStorage babykeystore.Storage) int {
+	ks, err := babykeystore.NewKeyStore(keyStoreStorage, babykeystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	defer ks.Close()
+	return len(ks.Keys())
+}
+
+func TestNewIssuer(t *testing.T) {
+	storage := db.NewMemoryStorage()
+	keyStoreStorage := &babykeystore.MemStorage{}
+	configTOML, err := newIssuer(storage, keyStoreStorage, babykeystore.LightKeyStoreParams,
+		[]byte("pass"), 10)
+	require.Nil(t, err)
+
+	var cfg identityConfig
+	require.Nil(t, config.Load(string(configTOML), &cfg))
+	require.Equal(t, 1, keyStoreKeys(t, keyStoreStorage))
+	idenStorage := loaders.IdenStorage(storage, &cfg.Identity.Id)
+	require.Nil(t, loaders.CheckGenesis(idenStorage, &cfg.Identity))
+	version, err := loaders.LoadSchemaVersion(storage)
+	require.Nil(t, err)
+	require.Equal(t, loaders.SchemaVersion, version)
+}
+
+func TestNewIssuerRollback(t *testing.T) {
+	// The key is removed when the identity can't be stored
+	storage := db.NewMemoryStorage()
+	keyStoreStorage := &babykeystore.MemStorage{}
+	_, err := newIssuer(&failCommitStorage{storage}, keyStoreStorage, babykeystore.LightKeyStoreParams,
+		[]byte("pass"), 10)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "commit failed")
+	require.Equal(t, 0, keyStoreKeys(t, keyStoreStorage))
+	require.Equal(t, 0, storageLen(t, storage))
+
+	// The identity isn't stored when the key can't be imported
+	_, err = newIssuer(storage, &failWriteKeyStorage{}, babykeystore.LightKeyStoreParams,
+		[]byte("pass"), 10)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "write failed")
+	require.Equal(t, 0, storageLen(t, storage))
+}
+
+func TestDbRawImportDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rawimport")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cfgStorage := &config.Storage{Type: loaders.StorageTypeBolt, Path: filepath.Join(dir, "storage.db")}
+	storage, err := loaders.LoadStorage(cfgStorage)
+	require.Nil(t, err)
+	storage.Close()
+	dump := filepath.Join(dir, "dump")
+	require.Nil(t, ioutil.WriteFile(dump, []byte(rawDumpLine([]byte("k"), []byte("v"))+"\n"), 0600))
+
+	// A reader like a running db command doesn't block the dry run
+	reader, err := loaders.LoadStorageReadOnly(cfgStorage)
+	require.Nil(t, err)
+	defer reader.Close()
+	set := flag.NewFlagSet("rawimport", flag.ContinueOnError)
+	set.Bool("dry-run", true, "")
+	set.String("prefix", "", "")
+	set.Bool("force", false, "")
+	require.Nil(t, set.Parse([]string{dump}))
+	require.Nil(t, CmdDbRawImport(cli.NewContext(nil, set, nil), cfgStorage))
+	_, err = reader.Get([]byte("k"))
+	require.Equal(t, db.ErrNotFound, err)
+}
+
+func TestDbMigrateDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	cfg := &config.Config{}
+	cfg.Storage = config.Storage{Type: loaders.StorageTypeBolt, Path: filepath.Join(dir, "storage.db")}
+	storage, err := loaders.LoadStorage(&cfg.Storage)
+	require.Nil(t, err)
+	tx, err := storage.NewTx()
+	require.Nil(t, err)
+	tx.Put([]byte("k"), []byte("v"))
+	require.Nil(t, tx.Commit())
+	storage.Close()
+
+	// A reader like a running db command doesn't block the dry run
+	reader, err := loaders.LoadStorageReadOnly(&cfg.Storage)
+	require.Nil(t, err)
+	defer reader.Close()
+	require.Nil(t, migrateStorage(cfg, true))
+	version, err := loaders.LoadSchemaVersion(reader)
+	require.Nil(t, err)
+	require.Equal(t, 0, version)
+}
@@ -0,0 +1,380 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	babykeystore "github.com/iden3/go-iden3-core/keystore"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-servers/backup"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/iden3/go-iden3-servers/loaders"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const (
+	identityArchiveVersion = 1
+	fileKeyStoreBaby       = "keystorebaby.json"
+	fileIdentity           = "identity.toml"
+)
+
+// identityArchive is the file written by identity export: a backup archive
+// of the identity storage with its babyjub keystore and Identity config,
+// encrypted with the export password.
+type identityArchive struct {
+	Version   int
+	Id        core.ID
+	Encrypted babykeystore.EncryptedData
+}
+
+type identityConfig struct {
+	Identity config.Identity `validate:"required"`
+}
+
+func archivePassword(c *cli.Context) (string, error) {
+	var password config.Password
+	if c.String("password") == "" {
+		return "", fmt.Errorf("Missing --password flag")
+	}
+	if err := password.UnmarshalText([]byte(c.String("password"))); err != nil {
+		return "", err
+	}
+	return password.Value, nil
+}
+
+// readBabyKey returns the encrypted babyjub key kOp from the keystore
+// storage.
+func readBabyKey(keyStoreStorage babykeystore.Storage, kOp *babyjub.PublicKeyComp) (*babykeystore.EncryptedData, error) {
+	if ok, err := keyStoreStorage.TryLock(); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, fmt.Errorf("Babyjub keystore locked by running server")
+	}
+	defer keyStoreStorage.Unlock() //nolint:errcheck
+	keysJSON, err := keyStoreStorage.Read()
+	if err != nil {
+		return nil, err
+	}
+	var keys babykeystore.KeysStored
+	if err := json.Unmarshal(keysJSON, &keys); err != nil {
+		return nil, err
+	}
+	encKey, ok := keys[*kOp]
+	if !ok {
+		return nil, fmt.Errorf("Babyjub key %v not found in keystore", kOp)
+	}
+	return &encKey, nil
+}
+
+// decryptBabyKey decrypts the babyjub key and checks that it's kOp.
+func decryptBabyKey(encKey *babykeystore.EncryptedData, password string,
+	kOp *babyjub.PublicKeyComp) (*babyjub.PrivateKey, error) {
+	skBytes, err := babykeystore.DecryptData(encKey, []byte(password))
+	if err != nil {
+		return nil, fmt.Errorf("Error decrypting babyjub key with the KeyStoreBaby password: %w", err)
+	}
+	var sk babyjub.PrivateKey
+	copy(sk[:], skBytes)
+	if sk.Public().Compress() != *kOp {
+		return nil, fmt.Errorf("Babyjub key doesn't match kOp %v", kOp)
+	}
+	return &sk, nil
+}
+
+// hostedIdentity returns the Identity config of the identity id hosted by
+// the issuer, configured or created at runtime.  An empty id is the main
+// identity.
+func hostedIdentity(cfg *config.Config, storage db.Storage, id string) (*config.Identity, error) {
+	if id == "" {
+		return &cfg.Identity, nil
+	}
+	hosted, err := loaders.LoadAllHostedIdentities(cfg, storage)
+	if err != nil {
+		return nil, err
+	}
+	for i := range hosted {
+		if hosted[i].Id.String() == id {
+			return &hosted[i].Identity, nil
+		}
+	}
+	return nil, fmt.Errorf("Identity %v not hosted by the issuer", id)
+}
+
+// CmdIdentityExport writes the identity given by --id, by default the main
+// one, to the encrypted archive file given as argument.  The archive has the
+// key values under the identity storage prefix, the encrypted babyjub key
+// kOp and the Identity config.
+func CmdIdentityExport(c *cli.Context) error {
+	path := c.Args().Get(0)
+	if path == "" {
+		return fmt.Errorf("Missing archive file argument")
+	}
+	password, err := archivePassword(c)
+	if err != nil {
+		return err
+	}
+	var cfg struct {
+		Identity     config.Identity         `validate:"required"`
+		Identities   []config.HostedIdentity `validate:"dive"`
+		KeyStoreBaby config.KeyStore         `validate:"required"`
+		Storage      config.Storage          `validate:"required"`
+	}
+	if err := config.LoadFromCliFlag(c, &cfg); err != nil {
+		return err
+	}
+	storage, err := loaders.LoadStorageReadOnly(&cfg.Storage)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	cfgIden, err := hostedIdentity(&config.Config{Identity: cfg.Identity, Identities: cfg.Identities},
+		storage, c.String("id"))
+	if err != nil {
+		return err
+	}
+	archive, manifest, err := exportIdentity(storage, babykeystore.NewFileStorage(cfg.KeyStoreBaby.Path),
+		cfg.KeyStoreBaby.Password.Value, cfgIden, password, babykeystore.StandardKeyStoreParams)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, func(w io.Writer) error {
+		return json.NewEncoder(w).Encode(archive)
+	}); err != nil {
+		return err
+	}
+	fmt.Printf("Exported %v keys of identity %v with state %v to %v\n",
+		manifest.Keys, &manifest.Id, manifest.State.Hex(), path)
+	return nil
+}
+
+// exportIdentity returns the archive of the identity cfgIden of storage,
+// with its babyjub key from the keystore storage, encrypted with password.
+func exportIdentity(storage db.Storage, keyStoreStorage babykeystore.Storage, keyStorePassword string,
+	cfgIden *config.Identity, password string,
+	params babykeystore.KeyStoreParams) (*identityArchive, *backup.Manifest, error) {
+	id := cfgIden.Id
+	kOp := cfgIden.Keys.BabyJub.KOp.Compress()
+	encKey, err := readBabyKey(keyStoreStorage, &kOp)
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err := decryptBabyKey(encKey, keyStorePassword, &kOp); err != nil {
+		return nil, nil, err
+	}
+	keysJSON, err := json.Marshal(babykeystore.KeysStored{kOp: *encKey})
+	if err != nil {
+		return nil, nil, err
+	}
+	var identityTOML bytes.Buffer
+	if err := toml.NewEncoder(&identityTOML).Encode(&identityConfig{Identity: *cfgIden}); err != nil {
+		return nil, nil, err
+	}
+
+	idenStorage := loaders.IdenStorage(storage, &id)
+	state, err := loaders.LoadIdenState(idenStorage)
+	if err != nil {
+		return nil, nil, err
+	}
+	version, err := loaders.LoadSchemaVersion(storage)
+	if err != nil {
+		return nil, nil, err
+	}
+	snapshot, err := backup.NewSnapshot(idenStorage)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer snapshot.Close()
+	manifest := &backup.Manifest{Id: id, State: state, SchemaVersion: version, Created: time.Now()}
+	var archive bytes.Buffer
+	if err := snapshot.WriteArchive(&archive, manifest,
+		backup.File{Name: fileKeyStoreBaby, Data: keysJSON},
+		backup.File{Name: fileIdentity, Data: identityTOML.Bytes()}); err != nil {
+		return nil, nil, err
+	}
+
+	encrypted, err := babykeystore.EncryptData(archive.Bytes(), []byte(password),
+		params.ScryptN, params.ScryptP)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &identityArchive{
+		Version:   identityArchiveVersion,
+		Id:        id,
+		Encrypted: *encrypted,
+	}, manifest, nil
+}
+
+// CmdIdentityImport imports the identity of the encrypted archive file given
+// as argument into the configured storage and babyjub keystore.  The archive
+// checksums, the identity state and the babyjub key are verified before
+// writing, and the identity must not be in the storage.  The babyjub key is
+// decrypted with the configured KeyStoreBaby password, which must be the one
+// of the exported keystore.
+func CmdIdentityImport(c *cli.Context) error {
+	path := c.Args().Get(0)
+	if path == "" {
+		return fmt.Errorf("Missing archive file argument")
+	}
+	password, err := archivePassword(c)
+	if err != nil {
+		return err
+	}
+	var cfg struct {
+		KeyStoreBaby config.KeyStore `validate:"required"`
+		Storage      config.Storage  `validate:"required"`
+	}
+	if err := config.LoadFromCliFlag(c, &cfg); err != nil {
+		return err
+	}
+
+	archiveJSON, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var archive identityArchive
+	if err := json.Unmarshal(archiveJSON, &archive); err != nil {
+		return fmt.Errorf("Invalid identity archive: %w", err)
+	}
+	storage, err := loaders.LoadStorage(&cfg.Storage)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	manifest, identityTOML, err := importIdentity(storage, babykeystore.NewFileStorage(cfg.KeyStoreBaby.Path),
+		babykeystore.StandardKeyStoreParams, cfg.KeyStoreBaby.Password.Value, &archive, password)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %v keys of identity %v with state %v from %v.\n",
+		manifest.Keys, &manifest.Id, manifest.State.Hex(), path)
+	fmt.Printf("Add the Identity section to the config file:\n---\n%s---\n", identityTOML)
+	return nil
+}
+
+// importIdentity verifies the archive decrypted with password and imports
+// its identity into storage and the keystore storage.  The identity is only
+// written to storage after its babyjub key is in the keystore, and the key
+// is removed from the keystore if the identity can't be written.  The
+// manifest and the Identity config of the archive are returned.
+func importIdentity(storage db.Storage, keyStoreStorage babykeystore.Storage,
+	params babykeystore.KeyStoreParams, keyStorePassword string,
+	archive *identityArchive, password string) (*backup.Manifest, []byte, error) {
+	if archive.Version != identityArchiveVersion {
+		return nil, nil, fmt.Errorf("Unsupported identity archive version %v", archive.Version)
+	}
+	plain, err := babykeystore.DecryptData(&archive.Encrypted, []byte(password))
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error decrypting identity archive: %w", err)
+	}
+	br, err := backup.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest := &br.Manifest
+	if manifest.Id != archive.Id {
+		return nil, nil, fmt.Errorf("Identity archive manifest is of identity %v, expected %v",
+			manifest.Id, archive.Id)
+	}
+	if manifest.SchemaVersion > loaders.SchemaVersion {
+		return nil, nil, fmt.Errorf("Identity archive schema version %v is newer than the supported %v",
+			manifest.SchemaVersion, loaders.SchemaVersion)
+	}
+	memStorage := db.NewMemoryStorage()
+	if err := br.Restore(memStorage); err != nil {
+		return nil, nil, err
+	}
+	files, err := br.Files()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var idenCfg identityConfig
+	if err := config.Load(string(files[fileIdentity]), &idenCfg); err != nil {
+		return nil, nil, fmt.Errorf("Invalid identity archive config: %w", err)
+	}
+	id := idenCfg.Identity.Id
+	kOp := idenCfg.Identity.Keys.BabyJub.KOp.Compress()
+	if id != manifest.Id {
+		return nil, nil, fmt.Errorf("Identity archive config is of identity %v, expected %v", id, manifest.Id)
+	}
+	if v, err := memStorage.Get([]byte("kop")); err != nil || !bytes.Equal(v, kOp[:]) {
+		return nil, nil, fmt.Errorf("Identity archive kOp doesn't match the stored one")
+	}
+	state, err := loaders.LoadIdenState(memStorage)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !state.Equals(manifest.State) {
+		return nil, nil, fmt.Errorf("Imported state %v doesn't match the archive state %v",
+			state.Hex(), manifest.State.Hex())
+	}
+	var keys babykeystore.KeysStored
+	if err := json.Unmarshal(files[fileKeyStoreBaby], &keys); err != nil {
+		return nil, nil, fmt.Errorf("Invalid identity archive keystore: %w", err)
+	}
+	encKey, ok := keys[kOp]
+	if !ok {
+		return nil, nil, fmt.Errorf("Babyjub key %v not found in the identity archive", &kOp)
+	}
+	sk, err := decryptBabyKey(&encKey, keyStorePassword, &kOp)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idenStorage := loaders.IdenStorage(storage, &id)
+	exists := false
+	if err := idenStorage.Iterate(func(k, v []byte) (bool, error) {
+		exists = true
+		return false, nil
+	}); err != nil {
+		return nil, nil, err
+	}
+	if exists {
+		return nil, nil, fmt.Errorf("Identity %v already in storage", &id)
+	}
+	if err := loaders.InitSchemaVersion(storage); err != nil {
+		return nil, nil, err
+	}
+	tx, err := idenStorage.NewTx()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Close()
+	if err := memStorage.Iterate(func(k, v []byte) (bool, error) {
+		tx.Put(k, v)
+		return true, nil
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	ks, err := babykeystore.NewKeyStore(keyStoreStorage, params)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error creating/opening babyjub keystore: %w", err)
+	}
+	defer ks.Close()
+	rollback := func() error { return nil }
+	hasKey := false
+	for _, pk := range ks.Keys() {
+		hasKey = hasKey || pk == kOp
+	}
+	if !hasKey {
+		if rollback, err = importBabyKey(ks, keyStoreStorage, sk, []byte(keyStorePassword)); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		if errRollback := rollback(); errRollback != nil {
+			log.WithError(errRollback).Error("Error rolling back babyjub key import")
+		}
+		return nil, nil, fmt.Errorf("Error storing identity: %w", err)
+	}
+	return manifest, files[fileIdentity], nil
+}
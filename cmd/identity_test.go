@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/db"
+	babykeystore "github.com/iden3/go-iden3-core/keystore"
+	"github.com/iden3/go-iden3-servers/backup"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/iden3/go-iden3-servers/loaders"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestIdentity(t *testing.T) (db.Storage, babykeystore.Storage, *config.Identity) {
+	storage := db.NewMemoryStorage()
+	keyStoreStorage := &babykeystore.MemStorage{}
+	configTOML, err := newIssuer(storage, keyStoreStorage, babykeystore.LightKeyStoreParams,
+		[]byte("pass"), 10)
+	require.Nil(t, err)
+	var cfg identityConfig
+	require.Nil(t, config.Load(string(configTOML), &cfg))
+	return storage, keyStoreStorage, &cfg.Identity
+}
+
+func TestIdentityExportImport(t *testing.T) {
+	storage, keyStoreStorage, cfgIden := newTestIdentity(t)
+	archive, manifest, err := exportIdentity(storage, keyStoreStorage, "pass", cfgIden,
+		"archivepass", babykeystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	require.Equal(t, cfgIden.Id, archive.Id)
+
+	dst := db.NewMemoryStorage()
+	dstKeyStoreStorage := &babykeystore.MemStorage{}
+	imported, identityTOML, err := importIdentity(dst, dstKeyStoreStorage,
+		babykeystore.LightKeyStoreParams, "pass", archive, "archivepass")
+	require.Nil(t, err)
+	require.Equal(t, manifest.Keys, imported.Keys)
+	var cfg identityConfig
+	require.Nil(t, config.Load(string(identityTOML), &cfg))
+	require.Equal(t, *cfgIden, cfg.Identity)
+	require.Nil(t, loaders.CheckGenesis(loaders.IdenStorage(dst, &cfgIden.Id), cfgIden))
+	state, err := loaders.LoadIdenState(loaders.IdenStorage(storage, &cfgIden.Id))
+	require.Nil(t, err)
+	importedState, err := loaders.LoadIdenState(loaders.IdenStorage(dst, &cfgIden.Id))
+	require.Nil(t, err)
+	require.Equal(t, state, importedState)
+	require.Equal(t, 1, keyStoreKeys(t, dstKeyStoreStorage))
+	ks, err := babykeystore.NewKeyStore(dstKeyStoreStorage, babykeystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	kOp := cfgIden.Keys.BabyJub.KOp.Compress()
+	require.Nil(t, ks.UnlockKey(&kOp, []byte("pass")))
+	ks.Close()
+
+	// The identity is already in the storage
+	n := storageLen(t, dst)
+	_, _, err = importIdentity(dst, dstKeyStoreStorage, babykeystore.LightKeyStoreParams,
+		"pass", archive, "archivepass")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "already in storage")
+	require.Equal(t, n, storageLen(t, dst))
+	require.Equal(t, 1, keyStoreKeys(t, dstKeyStoreStorage))
+}
+
+func TestIdentityImportRejected(t *testing.T) {
+	storage, keyStoreStorage, cfgIden := newTestIdentity(t)
+	archive, _, err := exportIdentity(storage, keyStoreStorage, "pass", cfgIden,
+		"archivepass", babykeystore.LightKeyStoreParams)
+	require.Nil(t, err)
+
+	importRejected := func(archive *identityArchive, password, keyStorePassword, msg string) {
+		dst := db.NewMemoryStorage()
+		dstKeyStoreStorage := &babykeystore.MemStorage{}
+		_, _, err := importIdentity(dst, dstKeyStoreStorage, babykeystore.LightKeyStoreParams,
+			keyStorePassword, archive, password)
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), msg)
+		require.Equal(t, 0, storageLen(t, dst))
+		require.Equal(t, 0, keyStoreKeys(t, dstKeyStoreStorage))
+	}
+	importRejected(archive, "wrongpass", "pass", "Error decrypting identity archive")
+	importRejected(archive, "archivepass", "wrongpass", "Error decrypting babyjub key")
+
+	tampered := *archive
+	tampered.Encrypted.EncryptedData = append([]byte{}, archive.Encrypted.EncryptedData...)
+	tampered.Encrypted.EncryptedData[len(tampered.Encrypted.EncryptedData)/2] ^= 1
+	importRejected(&tampered, "archivepass", "pass", "Error decrypting identity archive")
+
+	// Tampered by someone with the archive password
+	plain, err := babykeystore.DecryptData(&archive.Encrypted, []byte("archivepass"))
+	require.Nil(t, err)
+	br, err := backup.NewReader(bytes.NewReader(plain))
+	require.Nil(t, err)
+	mem := db.NewMemoryStorage()
+	require.Nil(t, br.Restore(mem))
+	files, err := br.Files()
+	require.Nil(t, err)
+	root, err := mem.Get([]byte("treeclaims:currentroot"))
+	require.Nil(t, err)
+	root = append([]byte{}, root...)
+	root[len(root)-1] ^= 1
+	tx, err := mem.NewTx()
+	require.Nil(t, err)
+	tx.Put([]byte("treeclaims:currentroot"), root)
+	require.Nil(t, tx.Commit())
+	snapshot, err := backup.NewSnapshot(mem)
+	require.Nil(t, err)
+	defer snapshot.Close()
+	var plainTampered bytes.Buffer
+	manifest := br.Manifest
+	require.Nil(t, snapshot.WriteArchive(&plainTampered, &manifest,
+		backup.File{Name: fileKeyStoreBaby, Data: files[fileKeyStoreBaby]},
+		backup.File{Name: fileIdentity, Data: files[fileIdentity]}))
+	encrypted, err := babykeystore.EncryptData(plainTampered.Bytes(), []byte("archivepass"),
+		babykeystore.LightScryptN, babykeystore.LightScryptP)
+	require.Nil(t, err)
+	tampered = *archive
+	tampered.Encrypted = *encrypted
+	importRejected(&tampered, "archivepass", "pass", "doesn't match the archive state")
+
+	tampered = *archive
+	tampered.Id[len(tampered.Id)-1] ^= 1
+	importRejected(&tampered, "archivepass", "pass", "manifest is of identity")
+
+	// The key is removed when the identity can't be stored
+	dst := db.NewMemoryStorage()
+	dstKeyStoreStorage := &babykeystore.MemStorage{}
+	_, _, err = importIdentity(&failCommitStorage{dst}, dstKeyStoreStorage,
+		babykeystore.LightKeyStoreParams, "pass", archive, "archivepass")
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "commit failed")
+	require.Equal(t, 0, keyStoreKeys(t, dstKeyStoreStorage))
+}
+
+func TestHostedIdentity(t *testing.T) {
+	storage, _, cfgIden := newTestIdentity(t)
+	cfg := &config.Config{Identity: *cfgIden}
+	iden, err := hostedIdentity(cfg, storage, "")
+	require.Nil(t, err)
+	require.Equal(t, cfgIden, iden)
+	iden, err = hostedIdentity(cfg, storage, cfgIden.Id.String())
+	require.Nil(t, err)
+	require.Equal(t, *cfgIden, *iden)
+	_, err = hostedIdentity(cfg, storage, "117D1GdPubM5NrwTH2Da44SMQFndg87m6kwVQTswLZ")
+	require.NotNil(t, err)
+}
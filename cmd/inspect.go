@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/iden3/go-iden3-servers/inspect"
+	"github.com/iden3/go-iden3-servers/loaders"
+	"github.com/urfave/cli"
+)
+
+// CmdDbInspect prints the decoded key values of the storage as JSON, one per
+// line, filtered by the --id and --kind flags.  For every identity a summary
+// with its state, pending state and on chain state is printed at the end.
+func CmdDbInspect(c *cli.Context, cfgStorage *config.Storage) error {
+	kinds := make(map[string]bool)
+	if c.String("kind") != "" {
+		for _, kind := range strings.Split(c.String("kind"), ",") {
+			kinds[kind] = true
+		}
+		for kind := range kinds {
+			if !contains(inspect.Kinds, kind) {
+				return fmt.Errorf("Unknown kind %v, available kinds: %v",
+					kind, strings.Join(inspect.Kinds, ","))
+			}
+		}
+	}
+	var prefix []byte
+	if c.String("id") != "" {
+		id, err := core.IDFromString(c.String("id"))
+		if err != nil {
+			return fmt.Errorf("Invalid identity: %w", err)
+		}
+		prefix = []byte(fmt.Sprintf("%v:", &id))
+	}
+
+	storage, err := loaders.LoadStorageReadOnly(cfgStorage)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	enc := json.NewEncoder(os.Stdout)
+	ids := []core.ID{}
+	idsSeen := make(map[core.ID]bool)
+	if err := storage.WithPrefix(prefix).Iterate(func(k, v []byte) (bool, error) {
+		e := inspect.Decode(append(append([]byte{}, prefix...), k...), v)
+		if e.Id != nil && !idsSeen[*e.Id] {
+			idsSeen[*e.Id] = true
+			ids = append(ids, *e.Id)
+		}
+		if len(kinds) != 0 && !kinds[e.Kind] {
+			return true, nil
+		}
+		return true, enc.Encode(e)
+	}); err != nil {
+		return err
+	}
+
+	if len(kinds) != 0 && !kinds[inspect.KindSummary] {
+		return nil
+	}
+	for i := range ids {
+		if err := enc.Encode(&inspect.Entry{
+			Id:    &ids[i],
+			Kind:  inspect.KindSummary,
+			Value: idenSummary(loaders.IdenStorage(storage, &ids[i])),
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// idenSummary returns the state, pending state and on chain state of the
+// identity stored in idenStorage.  The values that can't be loaded are
+// replaced by their error.
+func idenSummary(idenStorage db.Storage) map[string]interface{} {
+	summary := make(map[string]interface{})
+	if state, err := loaders.LoadIdenState(idenStorage); err != nil {
+		summary["stateError"] = err.Error()
+	} else {
+		summary["state"] = state
+	}
+	for name, key := range map[string]string{
+		"pending":           "idenstatepending",
+		"pendingTransacted": "idenstatependingtxed",
+		"onchain":           "idenstatedataonchain",
+	} {
+		v, err := idenStorage.Get([]byte(key))
+		if err != nil {
+			summary[name+"Error"] = err.Error()
+			continue
+		}
+		summary[name] = inspect.MetadataValue(key, v)
+	}
+	return summary
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
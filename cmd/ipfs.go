@@ -0,0 +1,116 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	common3 "github.com/iden3/go-iden3-core/common"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/iden3/go-iden3-servers/loaders"
+	shell "github.com/ipfs/go-ipfs-api"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli"
+)
+
+const ipfsApiDefault = "localhost:5001"
+
+// ipfsExport is the export of a key value.  The value is dropped once added,
+// so that only the key and its CID are kept until the manifest is written.
+type ipfsExport struct {
+	k, v []byte
+	cid  string
+	err  error
+}
+
+// CmdDbIPFSexport adds the values of the storage keys with the --prefix flag
+// prefix to the IPFS node, with up to --concurrency adds at a time.  The CID
+// of every exported key is written to the --manifest file in the rawdump
+// format.  Failed keys don't stop the export, but are reported at the end.
+func CmdDbIPFSexport(c *cli.Context, cfgStorage *config.Storage, cfgIpfs *config.Ipfs) error {
+	api := c.String("api")
+	if api == "" {
+		api = cfgIpfs.Api
+	}
+	if api == "" {
+		api = ipfsApiDefault
+	}
+	concurrency := c.Int("concurrency")
+	if concurrency < 1 {
+		return fmt.Errorf("Invalid concurrency %v", concurrency)
+	}
+	manifestPath := c.String("manifest")
+	if manifestPath == "" {
+		manifestPath = fmt.Sprintf("ipfsexport-%v.txt", time.Now().Unix())
+	}
+	prefix := []byte(c.String("prefix"))
+
+	sh := shell.NewShell(api)
+	if !sh.IsUp() {
+		return fmt.Errorf("IPFS node at %v is not reachable", api)
+	}
+	storage, err := loaders.LoadStorageReadOnly(cfgStorage)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	var exports []*ipfsExport
+	jobs := make(chan *ipfsExport)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range jobs {
+				e.cid, e.err = sh.Add(bytes.NewReader(e.v))
+				e.v = nil
+				if e.err != nil {
+					log.WithField("key", common3.HexEncode(e.k)).WithError(e.err).Error("ipfs add")
+				}
+			}
+		}()
+	}
+	err = storage.WithPrefix(prefix).Iterate(func(k, v []byte) (bool, error) {
+		e := &ipfsExport{k: append(append([]byte{}, prefix...), k...), v: append([]byte{}, v...)}
+		exports = append(exports, e)
+		jobs <- e
+		return true, nil
+	})
+	close(jobs)
+	wg.Wait()
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+	if err := writeFileAtomic(manifestPath, func(w io.Writer) error {
+		bw := bufio.NewWriter(w)
+		for _, e := range exports {
+			if e.err != nil {
+				failed++
+				continue
+			}
+			fmt.Fprintln(bw, common3.HexEncode(e.k)+", "+e.cid)
+		}
+		return bw.Flush()
+	}); err != nil {
+		return err
+	}
+
+	fmt.Printf("exported %v of %v keys to %v, manifest written to %v\n",
+		len(exports)-failed, len(exports), api, manifestPath)
+	if failed != 0 {
+		for _, e := range exports {
+			if e.err != nil {
+				fmt.Fprintf(os.Stderr, "failed %v: %v\n", common3.HexEncode(e.k), e.err)
+			}
+		}
+		return fmt.Errorf("Failed to export %v keys", failed)
+	}
+	return nil
+}
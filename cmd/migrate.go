@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/iden3/go-iden3-servers/loaders"
+	"github.com/urfave/cli"
+)
+
+// CmdDbMigrate upgrades the storage to the schema version of this server.  A
+// backup of the storage is written next to it before migrating.
+func CmdDbMigrate(c *cli.Context, cfg *config.Config) error {
+	return migrateStorage(cfg, c.Bool("dry-run"))
+}
+
+// migrateStorage runs the pending migrations of the storage after writing a
+// backup, or only prints them if dryRun is true.
+func migrateStorage(cfg *config.Config, dryRun bool) error {
+	load := loaders.LoadStorage
+	if dryRun {
+		load = loaders.LoadStorageReadOnly
+	}
+	sto, err := load(&cfg.Storage)
+	if err != nil {
+		return err
+	}
+	defer sto.Close()
+	version, pending, err := loaders.PendingMigrations(sto)
+	if err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		fmt.Printf("Storage schema version %v is up to date\n", version)
+		return nil
+	}
+	fmt.Printf("Storage schema version %v, pending migrations:\n", version)
+	for _, m := range pending {
+		fmt.Printf("  %v -> %v: %v\n", m.Version-1, m.Version, m.Description)
+	}
+	if dryRun {
+		return nil
+	}
+
+	if cfg.Storage.Type != loaders.StorageTypeMemory {
+		path := fmt.Sprintf("%v.pre-migrate-%v-%v.tar.gz", cfg.Storage.Path, version, time.Now().Unix())
+		if err := writeBackupFile(path, func(w io.Writer) error {
+			return backupStorage(sto, cfg, w)
+		}); err != nil {
+			return fmt.Errorf("Error writing pre-migration backup: %w", err)
+		}
+		fmt.Printf("Backup written to %v\n", path)
+	}
+	if err := loaders.Migrate(sto); err != nil {
+		return err
+	}
+	fmt.Printf("Storage migrated to schema version %v\n", loaders.SchemaVersion)
+	return nil
+}
@@ -0,0 +1,99 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/iden3/go-iden3-servers/inspect"
+	"github.com/iden3/go-iden3-servers/loaders"
+	"github.com/urfave/cli"
+)
+
+// CmdDbVerify verifies the merkle trees and identity states of the
+// identities in the storage, or only of the one given by the --id flag, and
+// prints a report.  An error is returned if any corruption is found.
+func CmdDbVerify(c *cli.Context, cfgStorage *config.Storage) error {
+	storage, err := loaders.LoadStorageReadOnly(cfgStorage)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+
+	var ids []core.ID
+	if c.String("id") != "" {
+		id, err := core.IDFromString(c.String("id"))
+		if err != nil {
+			return fmt.Errorf("Invalid identity: %w", err)
+		}
+		ids = append(ids, id)
+	} else if ids, err = storageIds(storage); err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		return fmt.Errorf("No identities found in storage")
+	}
+
+	corrupted := 0
+	for i := range ids {
+		report, err := inspect.Verify(loaders.IdenStorage(storage, &ids[i]))
+		if err != nil {
+			return fmt.Errorf("Error verifying identity %v: %w", &ids[i], err)
+		}
+		printReport(&ids[i], report)
+		if !report.Ok() {
+			corrupted++
+		}
+	}
+	if corrupted != 0 {
+		return fmt.Errorf("Corruption found in %v of %v identities", corrupted, len(ids))
+	}
+	return nil
+}
+
+// storageIds returns the identities with an issuer in storage.
+func storageIds(storage db.Storage) ([]core.ID, error) {
+	var ids []core.ID
+	if err := storage.Iterate(func(k, v []byte) (bool, error) {
+		if e := inspect.Decode(k, v); e.Kind == inspect.KindMetadata && e.Key == "id" {
+			ids = append(ids, *e.Id)
+		}
+		return true, nil
+	}); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+func printReport(id *core.ID, r *inspect.Report) {
+	fmt.Printf("Identity %v\n", id)
+	for _, tree := range inspect.Trees {
+		tr := r.Trees[tree]
+		fmt.Printf("  %v tree: root %v, %v nodes, %v leaves, %v unreachable\n",
+			tree, hashHex(tr.Root), tr.Nodes, tr.Leaves, tr.Unreachable)
+	}
+	fmt.Printf("  state:          %v\n", hashHex(r.State))
+	fmt.Printf("  last state:     %v (%v states)\n", hashHex(r.StateLast), r.States)
+	fmt.Printf("  pending state:  %v\n", hashHex(r.StatePending))
+	fmt.Printf("  on chain state: %v\n", hashHex(r.StateOnChain))
+	if r.State != nil && r.StateLast != nil && !r.State.Equals(r.StateLast) {
+		fmt.Printf("  state has changes not yet published\n")
+	}
+	for _, err := range r.Errors {
+		fmt.Printf("  ERROR: %v\n", err)
+	}
+	if r.Ok() {
+		fmt.Printf("  OK\n")
+	} else {
+		fmt.Printf("  CORRUPTED: %v errors\n", len(r.Errors))
+	}
+}
+
+func hashHex(h *merkletree.Hash) string {
+	if h == nil {
+		return "-"
+	}
+	return h.Hex()
+}
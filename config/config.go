@@ -4,8 +4,12 @@ import (
 
 	// common3 "github.com/iden3/go-iden3-core/common"
 
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net/url"
 	"strings"
 	"time"
 
@@ -31,9 +35,31 @@ func (d *Duration) UnmarshalText(data []byte) error {
 	return nil
 }
 
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.Duration.String()), nil
+}
+
+// BigInt is a big.Int that can be loaded from a decimal number or string.
+type BigInt struct {
+	big.Int
+}
+
+func (b *BigInt) UnmarshalText(data []byte) error {
+	if _, ok := b.Int.SetString(string(data), 10); !ok {
+		return fmt.Errorf("invalid integer %v", string(data))
+	}
+	return nil
+}
+
+func (b BigInt) MarshalText() ([]byte, error) {
+	return b.Int.MarshalText()
+}
+
 type Contract struct {
 	// JsonABI string         `validate:"required"`
 	Address common.Address `validate:"required"`
+	// CodeHash is the optional keccak256 hash of the deployed bytecode
+	CodeHash common.Hash
 }
 
 type Server struct {
@@ -53,9 +79,16 @@ func (p *Password) String() string {
 	return fmt.Sprintf("%v%v", prefixFile, *p.Path)
 }
 
+// MarshalText marshals the Password without revealing its content.  A
+// password read from a file is marshaled as its file path.
+func (p Password) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
 const (
 	prefixPassword = "password://"
 	prefixFile     = "file://"
+	prefixHidden   = "hidden:"
 )
 
 // UnmarshalText unmarshals the Password using the following rules
@@ -93,6 +126,58 @@ type EthKeys struct {
 	KUpdateRoot common.Address `validate:"required"`
 }
 
+// Account is the ethereum account used to publish the identity state.
+// Publishing is paused while the balance (in wei) is not enough to pay for a
+// state transition, a warning is logged when it's below WarnBalance, and the
+// server refuses to start when it's below MinBalance.
+type Account struct {
+	Address     common.Address `validate:"required"`
+	MinBalance  BigInt
+	WarnBalance BigInt
+}
+
+// Gas is the gas price policy of the transactions sent by the server.  The
+// gas price suggested by the web3 endpoint is multiplied by PriceMultiplier
+// and capped at MaxGasPrice (in wei).  A state transition transaction that is
+// not mined after StuckBlocks blocks is replaced by one with the same nonce
+// and the gas price increased by BumpPercent.  EIP-1559 fee caps are not
+// supported because the ethereum client library in use only signs legacy
+// transactions.
+type Gas struct {
+	MaxGasPrice     BigInt
+	PriceMultiplier float64 `validate:"gte=0"`
+	StuckBlocks     uint64
+	BumpPercent     uint64
+}
+
+// Storage is the configuration of the storage.  Type is the storage backend:
+// leveldb (default), bolt or memory.  Path is not used by the memory backend,
+// which is meant for tests and development.
+type Storage struct {
+	Type     string
+	Path     string
+	ReadOnly bool
+	LevelDb  LevelDb
+}
+
+// LevelDb is the tuning of the leveldb storage backend.  Sizes are in bytes
+// and zero values use the leveldb defaults.
+type LevelDb struct {
+	BlockCacheCapacity     int `validate:"gte=0"`
+	WriteBuffer            int `validate:"gte=0"`
+	OpenFilesCacheCapacity int `validate:"gte=0"`
+	CompactionTableSize    int `validate:"gte=0"`
+	CompactionTotalSize    int `validate:"gte=0"`
+	CompactionL0Trigger    int `validate:"gte=0"`
+	DisableSeeksCompaction bool
+}
+
+// Ipfs is the configuration of the IPFS node used by the database export.
+// Api is the address of its HTTP API, localhost:5001 by default.
+type Ipfs struct {
+	Api string
+}
+
 type Contracts struct {
 	IdenStates Contract `validate:"required"`
 	// Iden3Impl     Contract `validate:"required"`
@@ -112,8 +197,94 @@ type Identity struct {
 	} `validate:"required"`
 }
 
+// HostedIdentity is an additional identity hosted by the server, sharing its
+// storage, ethereum account and web3 connection.  The zero
+// PublishStatePeriod, SyncIdenStatePublicPeriod and IdenPubOffChain use the
+// ones of the Issuer and IdenPubOffChain sections.
+type HostedIdentity struct {
+	Identity
+	PublishStatePeriod        Duration
+	SyncIdenStatePublicPeriod Duration
+	IdenPubOffChain           *IdenPubOffChain
+}
+
+// BasicAuth are the credentials used for HTTP basic authentication.
+type BasicAuth struct {
+	Username string   `validate:"required"`
+	Password Password `validate:"required"`
+}
+
+// Web3Endpoint is the configuration of a web3 RPC endpoint.  The Url may
+// contain secrets (like API keys), so it's never shown in full: by default
+// only the scheme and host are shown, and nothing is shown if Hidden is true
+// or the Url is prefixed by 'hidden:'.  Timeout limits the duration of each
+// RPC request attempt and failed requests, except transaction sends, are
+// retried up to Retries times, waiting RetryDelay between attempts.
+// Headers, BasicAuth, Timeout, Retries and RetryDelay are only supported for
+// http(s) endpoints: setting them for a ws or ipc endpoint is an error.
+type Web3Endpoint struct {
+	Url        string `validate:"required"`
+	Hidden     bool
+	Headers    map[string]Password
+	BasicAuth  *BasicAuth
+	Timeout    Duration
+	Retries    int
+	RetryDelay Duration
+}
+
+// RawUrl returns the Url without the optional 'hidden:' prefix.
+func (e *Web3Endpoint) RawUrl() string {
+	return strings.TrimPrefix(e.Url, prefixHidden)
+}
+
+// IsHidden returns true if the Url must not be shown at all.
+func (e *Web3Endpoint) IsHidden() bool {
+	return e.Hidden || strings.HasPrefix(e.Url, prefixHidden)
+}
+
+// String returns the Url redacted so that it can be used in logs and errors.
+func (e *Web3Endpoint) String() string {
+	if e.IsHidden() {
+		return "(hidden)"
+	}
+	u, err := url.Parse(e.RawUrl())
+	if err != nil {
+		return "(invalid)"
+	}
+	if u.Scheme == "" || u.Scheme == "file" {
+		// IPC socket path
+		return e.RawUrl()
+	}
+	if u.User == nil && (u.Path == "" || u.Path == "/") && u.RawQuery == "" && u.Fragment == "" {
+		return u.String()
+	}
+	return fmt.Sprintf("%v://%v/***", u.Scheme, u.Host)
+}
+
+// Web3HealthCheck configures the periodic health check of the web3
+// endpoints.  An endpoint is unhealthy when its block height lags more than
+// MaxBlockLag blocks behind the highest one, or when its recent error rate
+// (between 0 and 1) is higher than MaxErrorRate.
+type Web3HealthCheck struct {
+	Period       Duration
+	MaxBlockLag  uint64
+	MaxErrorRate float64
+}
+
+// Web3 is the configuration of the web3 connection.  Endpoints are optional
+// http(s) endpoints to fail over to when the main one is unhealthy.  ChainId
+// is the expected chain ID of all the endpoints; if it's not set, the one of
+// the main endpoint is used.
 type Web3 struct {
-	Url string `validate:"required"`
+	Web3Endpoint
+	ChainId     uint64
+	Endpoints   []Web3Endpoint `validate:"dive"`
+	HealthCheck Web3HealthCheck
+}
+
+// AllEndpoints returns the main endpoint followed by the failover Endpoints.
+func (w *Web3) AllEndpoints() []Web3Endpoint {
+	return append([]Web3Endpoint{w.Web3Endpoint}, w.Endpoints...)
 }
 
 type IdenPubOffChain struct {
@@ -128,14 +299,26 @@ type ZkFilesHashes struct {
 	WitnessCalcWASM string `validate:"required"`
 }
 
+// ZkFiles are the zk files in Path.  The missing files are downloaded from
+// Url, or from the Mirrors tried in order after it, which can be http(s)://
+// or file:// base urls.
 type ZkFiles struct {
 	Url              string
+	Mirrors          []string
 	Path             string `validate:"required"`
 	ProvingKeyFormat zkutils.ProvingKeyFormat
 	CacheProvingKey  bool
 	Hashes           ZkFilesHashes `validate:"required"`
 }
 
+// Sources returns the Url followed by the Mirrors.
+func (z *ZkFiles) Sources() []string {
+	if z.Url == "" {
+		return z.Mirrors
+	}
+	return append([]string{z.Url}, z.Mirrors...)
+}
+
 func (z *ZkFiles) Value() *zkutils.ZkFiles {
 	if z.ProvingKeyFormat == "" {
 		z.ProvingKeyFormat = zkutils.ProvingKeyFormatJSON
@@ -149,7 +332,8 @@ func (z *ZkFiles) Value() *zkutils.ZkFiles {
 }
 
 type Config struct {
-	Identity Identity `validate:"required"`
+	Identity   Identity         `validate:"required"`
+	Identities []HostedIdentity `validate:"dive"`
 	// Domain    string       `validate:"required"`
 	// Namespace string       `validate:"required"`
 	Server       Server    `validate:"required"`
@@ -157,13 +341,11 @@ type Config struct {
 	KeyStore     KeyStore  `validate:"required"`
 	KeyStoreBaby KeyStore  `validate:"required"`
 	Contracts    Contracts `validate:"required"`
-	Account      struct {
-		Address common.Address `validate:"required"`
-	} `validate:"required"`
-	Storage struct {
-		Path string
-	} `validate:"required"`
-	Issuer struct {
+	Account      Account   `validate:"required"`
+	Gas          Gas
+	Storage      Storage `validate:"required"`
+	Ipfs         Ipfs
+	Issuer       struct {
 		PublishStatePeriod        Duration `validate:"required"`
 		SyncIdenStatePublicPeriod Duration `validate:"required"`
 		ConfirmBlocks             uint64   `validate:"required"`
@@ -172,6 +354,11 @@ type Config struct {
 	IdenStateZKProof struct {
 		Levels int     `validate:"required"`
 		Files  ZkFiles `validate:"required"`
+		// Workers is the number of proofs generated in parallel (default
+		// 1) and Timeout the maximum time a state transition waits for its
+		// proof (default unlimited).
+		Workers int
+		Timeout Duration
 	} `validate:"required"`
 	// Names struct {
 	// 	Path string `validate:"required"`
@@ -181,6 +368,72 @@ type Config struct {
 	// } `validate:"required"`
 }
 
+// Redacted returns a copy of the Config with the secrets that are not already
+// hidden by their type (like Password) redacted.
+func (cfg *Config) Redacted() *Config {
+	redacted := *cfg
+	redacted.Web3.Url = redacted.Web3.String()
+	redacted.Web3.Endpoints = make([]Web3Endpoint, len(cfg.Web3.Endpoints))
+	for i, endpoint := range cfg.Web3.Endpoints {
+		endpoint.Url = endpoint.String()
+		redacted.Web3.Endpoints[i] = endpoint
+	}
+	return &redacted
+}
+
+// HostedIdentities returns the main Identity followed by the Identities, with
+// the unset periods and IdenPubOffChain taken from the Issuer and
+// IdenPubOffChain sections.  An error is returned if an identity is
+// repeated.
+func (cfg *Config) HostedIdentities() ([]HostedIdentity, error) {
+	all := append([]HostedIdentity{{Identity: cfg.Identity}}, cfg.Identities...)
+	ids := make(map[core.ID]bool, len(all))
+	for i := range all {
+		iden := &all[i]
+		if ids[iden.Id] {
+			return nil, fmt.Errorf("Identity %v is repeated", &iden.Id)
+		}
+		ids[iden.Id] = true
+		cfg.SetHostedIdentityDefaults(iden)
+	}
+	return all, nil
+}
+
+// SetHostedIdentityDefaults sets the unset periods and IdenPubOffChain of
+// iden to the ones of the Issuer and IdenPubOffChain sections.
+func (cfg *Config) SetHostedIdentityDefaults(iden *HostedIdentity) {
+	if iden.PublishStatePeriod.Duration == 0 {
+		iden.PublishStatePeriod = cfg.Issuer.PublishStatePeriod
+	}
+	if iden.SyncIdenStatePublicPeriod.Duration == 0 {
+		iden.SyncIdenStatePublicPeriod = cfg.Issuer.SyncIdenStatePublicPeriod
+	}
+	if iden.IdenPubOffChain == nil {
+		iden.IdenPubOffChain = &cfg.IdenPubOffChain
+	}
+}
+
+const (
+	FormatTOML = "toml"
+	FormatJSON = "json"
+)
+
+// Marshal encodes the cfg in the specified format (FormatTOML or FormatJSON).
+func Marshal(cfg interface{}, format string) ([]byte, error) {
+	switch format {
+	case FormatTOML:
+		var cfgTOML bytes.Buffer
+		if err := toml.NewEncoder(&cfgTOML).Encode(cfg); err != nil {
+			return nil, err
+		}
+		return cfgTOML.Bytes(), nil
+	case FormatJSON:
+		return json.MarshalIndent(cfg, "", "  ")
+	default:
+		return nil, fmt.Errorf("invalid format %v.  Use '%v' or '%v'", format, FormatTOML, FormatJSON)
+	}
+}
+
 func LoadFromCliFlag(c *cli.Context, cfg interface{}) error {
 	cfgFilePath := c.GlobalString("config")
 	if cfgFilePath == "" {
@@ -0,0 +1,250 @@
+// Package inspect decodes the key values written in the storage by the issuer
+// server into structured entries.
+package inspect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// Kinds of entries.
+const (
+	KindMetadata   = "metadata"
+	KindIdenStates = "idenstates"
+	KindMtRoot     = "mt-root"
+	KindMtNode     = "mt-node"
+	KindWriterHttp = "writerhttp"
+	KindTxWatchdog = "txwatchdog"
+	KindUnknown    = "unknown"
+	// KindSummary is the kind of the identity summaries, which are not
+	// decoded from a single key value.
+	KindSummary = "summary"
+)
+
+// Kinds are all the entry kinds.
+var Kinds = []string{KindMetadata, KindIdenStates, KindMtRoot, KindMtNode,
+	KindWriterHttp, KindTxWatchdog, KindUnknown, KindSummary}
+
+var (
+	prefixWriterHttp = "writerhttp:"
+	prefixTxWatchdog = "txwatchdog:"
+	prefixIdenStates = "idenstates:"
+	mtPrefixes       = map[string]string{
+		"treeclaims:":     "claims",
+		"treerevocation:": "revocations",
+		"treeroots:":      "roots",
+	}
+	mtRootKey = []byte("currentroot")
+)
+
+// Entry is a decoded key value.  Key is the key without the identity prefix
+// in a readable form.  Raw is the hex encoded full key.
+type Entry struct {
+	Id    *core.ID    `json:"id,omitempty"`
+	Kind  string      `json:"kind"`
+	Tree  string      `json:"tree,omitempty"`
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+	Raw   string      `json:"raw"`
+}
+
+// MtNode is a decoded merkle tree node.
+type MtNode struct {
+	Type   string           `json:"type"`
+	ChildL *merkletree.Hash `json:"childL,omitempty"`
+	ChildR *merkletree.Hash `json:"childR,omitempty"`
+	Data   *merkletree.Data `json:"data,omitempty"`
+	HIndex *merkletree.Hash `json:"hIndex,omitempty"`
+	HValue *merkletree.Hash `json:"hValue,omitempty"`
+}
+
+// Decode decodes the key value k, v of the storage.
+func Decode(k, v []byte) *Entry {
+	e := &Entry{Kind: KindUnknown, Key: printable(k), Value: hexEncode(v), Raw: hexEncode(k)}
+	sep := bytes.IndexByte(k, ':')
+	if sep == -1 {
+		switch string(k) {
+		case "schemaversion":
+			e.Kind = KindMetadata
+			e.Value = uint32Value(v)
+		case "hostedidentities", "proverqueue":
+			e.Kind = KindMetadata
+			e.Value = jsonValue(v)
+		}
+		return e
+	}
+	id, err := core.IDFromString(string(k[:sep]))
+	if err != nil {
+		return e
+	}
+	e.Id = &id
+	key := k[sep+1:]
+	e.Key = printable(key)
+	switch {
+	case bytes.HasPrefix(key, []byte(prefixWriterHttp)):
+		decodeWriterHttp(e, key[len(prefixWriterHttp):], v)
+	case bytes.HasPrefix(key, []byte(prefixTxWatchdog)):
+		e.Kind = KindTxWatchdog
+		e.Value = jsonValue(v)
+	case bytes.HasPrefix(key, []byte(prefixIdenStates)):
+		decodeIdenStates(e, key[len(prefixIdenStates):], v)
+	default:
+		for prefix, tree := range mtPrefixes {
+			if bytes.HasPrefix(key, []byte(prefix)) {
+				decodeMt(e, tree, key[len(prefix):], v)
+				return e
+			}
+		}
+		decodeMetadata(e, string(key), v)
+	}
+	return e
+}
+
+// MetadataValue decodes the value v of the issuer metadata key.
+func MetadataValue(key string, v []byte) interface{} {
+	e := &Entry{Value: hexEncode(v)}
+	decodeMetadata(e, key, v)
+	return e.Value
+}
+
+func decodeMetadata(e *Entry, key string, v []byte) {
+	e.Kind = KindMetadata
+	switch key {
+	case "config", "genclaimkopmtp", "genclr", "idenstatedataonchain",
+		"ethtxsetstate", "ethtxinitstate":
+		e.Value = jsonValue(v)
+	case "claimkophi", "idenstatepending":
+		e.Value = hashValue(v)
+	case "id":
+		if id, err := core.IDFromBytes(v); err == nil {
+			e.Value = id
+		}
+	case "nonceidx":
+		e.Value = uint32Value(v)
+	case "idenstatependingtxed":
+		if len(v) == 1 {
+			e.Value = v[0] == 1
+		}
+	case "kop":
+		e.Value = hexEncode(v)
+	default:
+		e.Kind = KindUnknown
+	}
+}
+
+func decodeIdenStates(e *Entry, key, v []byte) {
+	e.Kind = KindIdenStates
+	switch {
+	case string(key) == "len":
+		e.Value = uint32Value(v)
+	case bytes.HasPrefix(key, []byte("list:")):
+		e.Key = prefixIdenStates + "list:" + hashValue(key[len("list:"):])
+		e.Value = jsonValue(v)
+	case bytes.HasPrefix(key, []byte("byidx:")):
+		if idx, ok := uint32Value(key[len("byidx:"):]).(uint32); ok {
+			e.Key = fmt.Sprintf("%vbyidx:%v", prefixIdenStates, idx)
+		}
+		e.Value = hashValue(v)
+	default:
+		e.Kind = KindUnknown
+	}
+}
+
+func decodeMt(e *Entry, tree string, key, v []byte) {
+	e.Tree = tree
+	if bytes.Equal(key, mtRootKey) {
+		e.Kind = KindMtRoot
+		if len(v) > 0 && merkletree.NodeType(v[0]) == merkletree.DBEntryTypeRoot {
+			e.Value = hashValue(v[1:])
+		}
+		return
+	}
+	node, err := merkletree.NewNodeFromBytes(v)
+	if err != nil || len(key) != merkletree.ElemBytesLen {
+		return
+	}
+	e.Kind = KindMtNode
+	e.Key = hashValue(key)
+	mtNode := MtNode{ChildL: node.ChildL, ChildR: node.ChildR}
+	switch node.Type {
+	case merkletree.NodeTypeMiddle:
+		mtNode.Type = "middle"
+	case merkletree.NodeTypeLeaf:
+		mtNode.Type = "leaf"
+		mtNode.Data = &node.Entry.Data
+		mtNode.HIndex, _ = node.Entry.HIndex()
+		mtNode.HValue, _ = node.Entry.HValue()
+	case merkletree.NodeTypeEmpty:
+		mtNode.Type = "empty"
+	}
+	e.Value = mtNode
+}
+
+func decodeWriterHttp(e *Entry, key, v []byte) {
+	e.Kind = KindWriterHttp
+	name := string(key)
+	if i := strings.LastIndexByte(name, '-'); i != -1 {
+		name = name[:i]
+	}
+	switch name {
+	case "config":
+		e.Value = jsonValue(v)
+	case "cacheidx":
+		if len(v) == 1 {
+			e.Value = v[0]
+		}
+	case "idenstate", "claimsroot", "rootsroot", "revocationsroot":
+		e.Value = hashValue(v)
+	case "rootstree", "revocationstree":
+		e.Value = struct {
+			Len int `json:"len"`
+		}{len(v)}
+	default:
+		e.Kind = KindUnknown
+	}
+}
+
+func jsonValue(v []byte) interface{} {
+	if !json.Valid(v) {
+		return hexEncode(v)
+	}
+	return json.RawMessage(v)
+}
+
+func hashValue(v []byte) string {
+	if len(v) != merkletree.ElemBytesLen {
+		return hexEncode(v)
+	}
+	var h merkletree.Hash
+	copy(h[:], v)
+	return h.Hex()
+}
+
+func uint32Value(v []byte) interface{} {
+	if len(v) != 4 {
+		return hexEncode(v)
+	}
+	return binary.LittleEndian.Uint32(v)
+}
+
+// printable returns k as a string, with the bytes from the first non
+// printable one hex encoded.
+func printable(k []byte) string {
+	for i, c := range k {
+		if c < 0x20 || c > 0x7e {
+			return string(k[:i]) + hexEncode(k[i:])
+		}
+	}
+	return string(k)
+}
+
+func hexEncode(b []byte) string {
+	return "0x" + hex.EncodeToString(b)
+}
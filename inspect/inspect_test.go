@@ -0,0 +1,110 @@
+package inspect
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/identity/issuer"
+	"github.com/iden3/go-iden3-core/keystore"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/stretchr/testify/require"
+)
+
+// newIssuerStorage returns a storage with a new issuer stored under the
+// identity prefix, like the server does.
+func newIssuerStorage(t *testing.T) (*core.ID, db.Storage) {
+	memStorage := db.NewMemoryStorage()
+	ksStorage := keystore.MemStorage([]byte{})
+	keyStore, err := keystore.NewKeyStore(&ksStorage, keystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	kOp, err := keyStore.NewKey([]byte("pass"))
+	require.Nil(t, err)
+	id, err := issuer.Create(issuer.ConfigDefault, kOp, []claims.Claimer{}, memStorage, keyStore)
+	require.Nil(t, err)
+	storage := db.NewMemoryStorage()
+	tx, err := storage.NewTx()
+	require.Nil(t, err)
+	require.Nil(t, memStorage.Iterate(func(k, v []byte) (bool, error) {
+		tx.Put([]byte(fmt.Sprintf("%v:%s", id, k)), v)
+		return true, nil
+	}))
+	require.Nil(t, tx.Commit())
+	return id, storage
+}
+
+func TestDecodeIssuerStorage(t *testing.T) {
+	id, storage := newIssuerStorage(t)
+	kinds := make(map[string]int)
+	require.Nil(t, storage.Iterate(func(k, v []byte) (bool, error) {
+		e := Decode(k, v)
+		require.NotEqual(t, KindUnknown, e.Kind, "key %v", e.Key)
+		require.Equal(t, *id, *e.Id)
+		kinds[e.Kind]++
+		if e.Key == "id" {
+			require.Equal(t, *id, e.Value)
+		}
+		return true, nil
+	}))
+	require.Equal(t, 3, kinds[KindMtRoot])
+	require.NotZero(t, kinds[KindMtNode])
+	require.NotZero(t, kinds[KindMetadata])
+	require.NotZero(t, kinds[KindIdenStates])
+
+	e := Decode([]byte("foo"), []byte{1})
+	require.Equal(t, KindUnknown, e.Kind)
+	require.Equal(t, "0x01", e.Value)
+}
+
+func TestVerify(t *testing.T) {
+	id, storage := newIssuerStorage(t)
+	idenStorage := storage.WithPrefix([]byte(fmt.Sprintf("%v:", id)))
+	report, err := Verify(idenStorage)
+	require.Nil(t, err)
+	require.True(t, report.Ok(), "%v", report.Errors)
+	require.Equal(t, report.State, report.StateLast)
+	require.Equal(t, 1, report.States)
+	require.NotZero(t, report.Trees["claims"].Leaves)
+
+	// Modify a leaf of the claims tree
+	var leafKey, leafValue []byte
+	clt := idenStorage.WithPrefix([]byte("treeclaims:"))
+	require.Nil(t, clt.Iterate(func(k, v []byte) (bool, error) {
+		if len(v) > 0 && merkletree.NodeType(v[0]) == merkletree.NodeTypeLeaf {
+			leafKey, leafValue = append([]byte{}, k...), append([]byte{}, v...)
+			return false, nil
+		}
+		return true, nil
+	}))
+	require.NotNil(t, leafKey)
+	tx, err := clt.NewTx()
+	require.Nil(t, err)
+	tx.Put(leafKey, append(leafValue[:len(leafValue)-1], leafValue[len(leafValue)-1]^1))
+	require.Nil(t, tx.Commit())
+	report, err = Verify(idenStorage)
+	require.Nil(t, err)
+	require.False(t, report.Ok())
+	require.Contains(t, report.Errors[0], "hash mismatch")
+
+	// Remove it
+	kvs := map[string][]byte{}
+	require.Nil(t, storage.Iterate(func(k, v []byte) (bool, error) {
+		kvs[string(k)] = v
+		return true, nil
+	}))
+	storage = db.NewMemoryStorage()
+	tx, err = storage.NewTx()
+	require.Nil(t, err)
+	for k, v := range kvs {
+		if k != fmt.Sprintf("%v:treeclaims:%s", id, leafKey) {
+			tx.Put([]byte(k), v)
+		}
+	}
+	require.Nil(t, tx.Commit())
+	report, err = Verify(storage.WithPrefix([]byte(fmt.Sprintf("%v:", id))))
+	require.Nil(t, err)
+	require.False(t, report.Ok())
+	require.Contains(t, report.Errors[0], "missing")
+}
@@ -0,0 +1,283 @@
+package inspect
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/proof"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/identity/issuer"
+	"github.com/iden3/go-iden3-core/merkletree"
+)
+
+// Trees of the issuer in the order used to calculate the identity state.
+var Trees = []string{"claims", "revocations", "roots"}
+
+var treePrefixes = map[string]string{
+	"claims":      "treeclaims:",
+	"revocations": "treerevocation:",
+	"roots":       "treeroots:",
+}
+
+// TreeReport is the result of verifying a merkle tree.  Nodes and Leaves are
+// the number of nodes reachable from the current root and the roots of the
+// past identity states.  Unreachable is the number of stored nodes that are
+// not reachable from any of them, which is not an error.
+type TreeReport struct {
+	Root        *merkletree.Hash `json:"root"`
+	Nodes       int              `json:"nodes"`
+	Leaves      int              `json:"leaves"`
+	Unreachable int              `json:"unreachable"`
+}
+
+// Report is the result of verifying the storage of an identity.  State is
+// the identity state recomputed from the current tree roots, StateLast the
+// last identity state stored in the history of states.  Errors describes the
+// corruption found.
+type Report struct {
+	Trees        map[string]*TreeReport `json:"trees"`
+	State        *merkletree.Hash       `json:"state"`
+	StateLast    *merkletree.Hash       `json:"stateLast"`
+	StatePending *merkletree.Hash       `json:"statePending"`
+	StateOnChain *merkletree.Hash       `json:"stateOnChain"`
+	States       int                    `json:"states"`
+	Errors       []string               `json:"errors"`
+}
+
+func (r *Report) errorf(format string, args ...interface{}) {
+	r.Errors = append(r.Errors, fmt.Sprintf(format, args...))
+}
+
+// Ok returns true if no corruption was found.
+func (r *Report) Ok() bool {
+	return len(r.Errors) == 0
+}
+
+// Verify walks the merkle trees of the identity stored in idenStorage
+// recomputing the hash of every node, and checks that the history of
+// identity states, the pending state and the on chain state are consistent
+// with them.  Corruption is reported in the returned Report; an error is
+// only returned when the storage can't be read.
+func Verify(idenStorage db.Storage) (*Report, error) {
+	r := &Report{Trees: make(map[string]*TreeReport)}
+	roots := make(map[string][]*merkletree.Hash)
+	for _, tree := range Trees {
+		root, err := idenStorage.WithPrefix([]byte(treePrefixes[tree])).Get(mtRootKey)
+		if errors.Is(err, db.ErrNotFound) {
+			r.errorf("%v tree: missing root", tree)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if len(root) != 1+merkletree.ElemBytesLen || merkletree.NodeType(root[0]) != merkletree.DBEntryTypeRoot {
+			r.errorf("%v tree: invalid root %v", tree, hexEncode(root))
+			continue
+		}
+		var h merkletree.Hash
+		copy(h[:], root[1:])
+		r.Trees[tree] = &TreeReport{Root: &h}
+		roots[tree] = append(roots[tree], &h)
+	}
+	if len(r.Trees) == len(Trees) {
+		r.State = core.IdenState(r.Trees["claims"].Root, r.Trees["revocations"].Root,
+			r.Trees["roots"].Root)
+	}
+
+	states, err := verifyIdenStates(idenStorage, r)
+	if err != nil {
+		return nil, err
+	}
+	for _, stateRoots := range states {
+		roots["claims"] = append(roots["claims"], stateRoots.ClaimsTreeRoot)
+		roots["revocations"] = append(roots["revocations"], stateRoots.RevocationsTreeRoot)
+		roots["roots"] = append(roots["roots"], stateRoots.RootsTreeRoot)
+	}
+	for _, tree := range Trees {
+		if r.Trees[tree] == nil {
+			r.Trees[tree] = &TreeReport{}
+		}
+		if err := verifyTree(idenStorage.WithPrefix([]byte(treePrefixes[tree])), tree,
+			roots[tree], r.Trees[tree], r); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := verifyStatePointers(idenStorage, states, r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// verifyIdenStates checks the history of identity states and returns the tree
+// roots of every state.
+func verifyIdenStates(idenStorage db.Storage, r *Report) (map[merkletree.Hash]*issuer.IdenStateTreeRoots, error) {
+	states := make(map[merkletree.Hash]*issuer.IdenStateTreeRoots)
+	sto := idenStorage.WithPrefix([]byte(prefixIdenStates))
+	lenBytes, err := sto.Get([]byte("len"))
+	if errors.Is(err, db.ErrNotFound) {
+		r.errorf("idenstates: missing length")
+		return states, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(lenBytes) != 4 {
+		r.errorf("idenstates: invalid length %v", hexEncode(lenBytes))
+		return states, nil
+	}
+	r.States = int(binary.LittleEndian.Uint32(lenBytes))
+	for idx := 0; idx < r.States; idx++ {
+		var idxBytes [4]byte
+		binary.LittleEndian.PutUint32(idxBytes[:], uint32(idx))
+		stateBytes, err := sto.Get(append([]byte("byidx:"), idxBytes[:]...))
+		if errors.Is(err, db.ErrNotFound) {
+			r.errorf("idenstates: missing state %v", idx)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if len(stateBytes) != merkletree.ElemBytesLen {
+			r.errorf("idenstates: invalid state %v: %v", idx, hexEncode(stateBytes))
+			continue
+		}
+		var state merkletree.Hash
+		copy(state[:], stateBytes)
+		rootsJSON, err := sto.Get(append([]byte("list:"), stateBytes...))
+		if errors.Is(err, db.ErrNotFound) {
+			r.errorf("idenstates: missing tree roots of state %v %v", idx, state.Hex())
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		var stateRoots issuer.IdenStateTreeRoots
+		if err := json.Unmarshal(rootsJSON, &stateRoots); err != nil ||
+			stateRoots.ClaimsTreeRoot == nil || stateRoots.RevocationsTreeRoot == nil ||
+			stateRoots.RootsTreeRoot == nil {
+			r.errorf("idenstates: invalid tree roots of state %v %v", idx, state.Hex())
+			continue
+		}
+		if s := core.IdenState(stateRoots.ClaimsTreeRoot, stateRoots.RevocationsTreeRoot,
+			stateRoots.RootsTreeRoot); !s.Equals(&state) {
+			r.errorf("idenstates: state %v %v doesn't match its tree roots, recomputed %v",
+				idx, state.Hex(), s.Hex())
+		}
+		states[state] = &stateRoots
+		if idx == r.States-1 {
+			r.StateLast = &state
+			// Claims are added to the claims tree and revocations to the
+			// revocation tree before being published, but the roots tree
+			// only changes when a state is published.
+			if root := r.Trees["roots"]; root != nil && !root.Root.Equals(stateRoots.RootsTreeRoot) {
+				r.errorf("roots tree: root %v doesn't match the last state roots tree root %v",
+					root.Root.Hex(), stateRoots.RootsTreeRoot.Hex())
+			}
+		}
+	}
+	return states, nil
+}
+
+// verifyTree walks the tree in sto from every root, and counts the stored
+// nodes that are not reachable.
+func verifyTree(sto db.Storage, tree string, roots []*merkletree.Hash, tr *TreeReport, r *Report) error {
+	visited := make(map[merkletree.Hash]bool)
+	type ref struct{ key, parent *merkletree.Hash }
+	stack := []ref{}
+	for _, root := range roots {
+		stack = append(stack, ref{root, nil})
+	}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if n.key.Equals(&merkletree.HashZero) || visited[*n.key] {
+			continue
+		}
+		visited[*n.key] = true
+		v, err := sto.Get(n.key[:])
+		if errors.Is(err, db.ErrNotFound) {
+			if n.parent == nil {
+				r.errorf("%v tree: missing root node %v", tree, n.key.Hex())
+			} else {
+				r.errorf("%v tree: missing node %v referenced by %v", tree, n.key.Hex(), n.parent.Hex())
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		node, err := merkletree.NewNodeFromBytes(v)
+		if err != nil {
+			r.errorf("%v tree: invalid node %v: %v", tree, n.key.Hex(), err)
+			continue
+		}
+		key, err := node.Key()
+		if err != nil {
+			r.errorf("%v tree: invalid node %v: %v", tree, n.key.Hex(), err)
+			continue
+		}
+		if !key.Equals(n.key) {
+			r.errorf("%v tree: node %v hash mismatch, recomputed %v", tree, n.key.Hex(), key.Hex())
+			continue
+		}
+		tr.Nodes++
+		switch node.Type {
+		case merkletree.NodeTypeMiddle:
+			stack = append(stack, ref{node.ChildL, n.key}, ref{node.ChildR, n.key})
+		case merkletree.NodeTypeLeaf:
+			tr.Leaves++
+		}
+	}
+
+	return sto.Iterate(func(k, v []byte) (bool, error) {
+		if bytes.Equal(k, mtRootKey) {
+			return true, nil
+		}
+		if len(k) != merkletree.ElemBytesLen {
+			r.errorf("%v tree: unexpected key %v", tree, printable(k))
+			return true, nil
+		}
+		var h merkletree.Hash
+		copy(h[:], k)
+		if !visited[h] {
+			tr.Unreachable++
+		}
+		return true, nil
+	})
+}
+
+// verifyStatePointers checks that the pending and on chain states are in
+// the history of identity states.
+func verifyStatePointers(idenStorage db.Storage, states map[merkletree.Hash]*issuer.IdenStateTreeRoots, r *Report) error {
+	pending, err := idenStorage.Get([]byte("idenstatepending"))
+	if errors.Is(err, db.ErrNotFound) {
+		r.errorf("missing pending state")
+	} else if err != nil {
+		return err
+	} else if len(pending) != merkletree.ElemBytesLen {
+		r.errorf("invalid pending state %v", hexEncode(pending))
+	} else {
+		r.StatePending = &merkletree.Hash{}
+		copy(r.StatePending[:], pending)
+		if !r.StatePending.Equals(&merkletree.HashZero) &&
+			(r.StateLast == nil || !r.StatePending.Equals(r.StateLast)) {
+			r.errorf("pending state %v is not the last state", r.StatePending.Hex())
+		}
+	}
+
+	var onChain proof.IdenStateData
+	onChainJSON, err := idenStorage.Get([]byte("idenstatedataonchain"))
+	if errors.Is(err, db.ErrNotFound) {
+		r.errorf("missing on chain state")
+	} else if err != nil {
+		return err
+	} else if err := json.Unmarshal(onChainJSON, &onChain); err != nil || onChain.IdenState == nil {
+		r.errorf("invalid on chain state %v", printable(onChainJSON))
+	} else {
+		r.StateOnChain = onChain.IdenState
+		if _, ok := states[*r.StateOnChain]; !ok && !r.StateOnChain.Equals(&merkletree.HashZero) {
+			r.errorf("on chain state %v is not in the history of states", r.StateOnChain.Hex())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package loaders
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-servers/backup"
+)
+
+// Snapshot copies the storage for a backup with the publish and sync loops
+// paused.  The returned snapshot must be closed after writing the archive.
+func (s *Server) Snapshot() (*backup.Snapshot, *backup.Manifest, error) {
+	manifest := &backup.Manifest{
+		Id:            *s.Issuer.ID(),
+		SchemaVersion: SchemaVersion,
+		Created:       time.Now(),
+	}
+	var snapshot *backup.Snapshot
+	if err := s.WithLoopsPaused(func() error {
+		manifest.State, _ = s.Issuer.State()
+		for _, iden := range s.Identities() {
+			state, _ := iden.Issuer.State()
+			manifest.Identities = append(manifest.Identities,
+				backup.IdentityState{Id: *iden.Issuer.ID(), State: state})
+		}
+		var err error
+		snapshot, err = backup.NewSnapshot(s.Storage)
+		return err
+	}); err != nil {
+		return nil, nil, err
+	}
+	return snapshot, manifest, nil
+}
+
+// IdentityStates returns the states of the identities ids stored in storage.
+func IdentityStates(storage db.Storage, ids []core.ID) ([]backup.IdentityState, error) {
+	states := make([]backup.IdentityState, len(ids))
+	for i := range ids {
+		state, err := LoadIdenState(IdenStorage(storage, &ids[i]))
+		if err != nil {
+			return nil, fmt.Errorf("Error loading state of identity %v: %w", &ids[i], err)
+		}
+		states[i] = backup.IdentityState{Id: ids[i], State: state}
+	}
+	return states, nil
+}
+
+// CheckIdentityStates checks that the states of the identities of the
+// manifest are the ones stored in storage.
+func CheckIdentityStates(storage db.Storage, manifest *backup.Manifest) error {
+	expected := append([]backup.IdentityState{{Id: manifest.Id, State: manifest.State}},
+		manifest.Identities...)
+	for _, iden := range expected {
+		state, err := LoadIdenState(IdenStorage(storage, &iden.Id))
+		if err != nil {
+			return fmt.Errorf("Error loading state of identity %v: %w", &iden.Id, err)
+		}
+		if !state.Equals(iden.State) {
+			return fmt.Errorf("State %v of identity %v doesn't match the manifest state %v",
+				state, &iden.Id, iden.State)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package loaders
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/iden3/go-iden3-servers/backup"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckIdentityStates(t *testing.T) {
+	storage := db.NewMemoryStorage()
+	var ids []core.ID
+	for i := 0; i < 2; i++ {
+		id, _, tx, err := CreateIdentity(storage, 10)
+		require.Nil(t, err)
+		require.Nil(t, tx.Commit())
+		ids = append(ids, *id)
+	}
+	states, err := IdentityStates(storage, ids)
+	require.Nil(t, err)
+	manifest := &backup.Manifest{Id: ids[0], State: states[0].State, Identities: states,
+		SchemaVersion: SchemaVersion, Created: time.Now()}
+
+	snapshot, err := backup.NewSnapshot(storage)
+	require.Nil(t, err)
+	defer snapshot.Close()
+	var archive bytes.Buffer
+	require.Nil(t, snapshot.WriteArchive(&archive, manifest))
+	br, err := backup.NewReader(bytes.NewReader(archive.Bytes()))
+	require.Nil(t, err)
+	require.Equal(t, 2, len(br.Manifest.Identities))
+	restored := db.NewMemoryStorage()
+	require.Nil(t, br.Restore(restored))
+	require.Nil(t, CheckIdentityStates(restored, &br.Manifest))
+
+	// The state of the second identity is checked too
+	br.Manifest.Identities[1].State = &merkletree.HashZero
+	err = CheckIdentityStates(restored, &br.Manifest)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), ids[1].String())
+
+	// Identity missing in the storage
+	_, err = IdentityStates(restored, []core.ID{*proverTestId(1)})
+	require.NotNil(t, err)
+}
@@ -0,0 +1,124 @@
+package loaders
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/iden3/go-iden3-servers/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// minBalanceDefault is the MinBalance used when it's not configured.
+const minBalanceDefault = 3000000
+
+var (
+	metricBalanceGwei        = metrics.NewGauge("issuer/account/balance/gwei")
+	metricBalanceLow         = metrics.NewGauge("issuer/account/balance/low")
+	metricPublishStatePaused = metrics.NewGauge("issuer/publishstate/paused")
+)
+
+var weiPerGwei = big.NewInt(1000000000)
+
+// Funds is the last known balance of the account and the estimated cost of
+// publishing a state transition, both in wei.
+type Funds struct {
+	Balance          *big.Int  `json:"balance"`
+	PublishStateCost *big.Int  `json:"publishStateCost"`
+	Low              bool      `json:"low"`
+	Enough           bool      `json:"enough"`
+	Updated          time.Time `json:"updated"`
+}
+
+// minBalance returns the configured MinBalance or the default one.
+func (s *Server) minBalance() *big.Int {
+	if s.Cfg.Account.MinBalance.Sign() == 0 {
+		return big.NewInt(minBalanceDefault)
+	}
+	return &s.Cfg.Account.MinBalance.Int
+}
+
+// estimatePublishStateCost returns the maximum cost in wei of a state
+// transition transaction at the gas price it would be sent with now.
+func (s *Server) estimatePublishStateCost() (*big.Int, error) {
+	var gasPrice *big.Int
+	if err := s.EthClient.Call(func(c *ethclient.Client) (err error) {
+		gasPrice, err = suggestGasPrice(c, s.gasPolicy)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return gasPrice.Mul(gasPrice, big.NewInt(idenStatesGasLimit)), nil
+}
+
+// CheckFunds retrieves the account balance and the estimated cost of a state
+// transition, logs a warning if the balance is low and updates the metrics.
+func (s *Server) CheckFunds() (*Funds, error) {
+	address := s.EthClient.Account().Address
+	balance, err := s.EthClient.BalanceAt(address)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting account balance: %w", err)
+	}
+	cost, err := s.estimatePublishStateCost()
+	if err != nil {
+		return nil, fmt.Errorf("Error estimating state transition cost: %w", err)
+	}
+	funds := &Funds{
+		Balance:          balance,
+		PublishStateCost: cost,
+		Low:              balance.Cmp(&s.Cfg.Account.WarnBalance.Int) == -1,
+		Enough:           balance.Cmp(cost) != -1,
+		Updated:          time.Now(),
+	}
+	s.rw.Lock()
+	s.funds = funds
+	s.rw.Unlock()
+
+	metricBalanceGwei.Update(new(big.Int).Div(balance, weiPerGwei).Int64())
+	metricBalanceLow.Update(bool2int64(funds.Low))
+	metricPublishStatePaused.Update(bool2int64(!funds.Enough))
+
+	logger := log.WithFields(log.Fields{
+		"balance": balance.String(),
+		"cost":    cost.String(),
+		"address": address.Hex(),
+	})
+	if !funds.Enough {
+		logger.Error("Not enough funds in the ethereum account to publish the state")
+	} else if funds.Low {
+		logger.WithField("warnBalance", s.Cfg.Account.WarnBalance.String()).
+			Warn("Low funds in the ethereum account")
+	} else {
+		logger.Debug("Account balance retrieved")
+	}
+	return funds, nil
+}
+
+// CheckMinBalance returns an error if the account balance is below the
+// MinBalance.
+func (s *Server) CheckMinBalance() error {
+	funds, err := s.CheckFunds()
+	if err != nil {
+		return err
+	}
+	if funds.Balance.Cmp(s.minBalance()) == -1 {
+		return fmt.Errorf("Not enough funds in the ethereum address: balance %v is below %v",
+			funds.Balance, s.minBalance())
+	}
+	return nil
+}
+
+// Funds returns the last known funds of the account.
+func (s *Server) Funds() *Funds {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	return s.funds
+}
+
+func bool2int64(v bool) int64 {
+	if v {
+		return 1
+	}
+	return 0
+}
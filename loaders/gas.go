@@ -0,0 +1,164 @@
+package loaders
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	ethkeystore "github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	zktypes "github.com/iden3/go-circom-prover-verifier/types"
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/eth"
+	"github.com/iden3/go-iden3-core/eth/contracts"
+	"github.com/iden3/go-iden3-core/merkletree"
+	zkutils "github.com/iden3/go-iden3-core/utils/zk"
+	"github.com/iden3/go-iden3-servers/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// GasPolicy computes the gas price of the transactions from the one suggested
+// by the web3 endpoint.
+type GasPolicy struct {
+	MaxGasPrice *big.Int
+	Multiplier  float64
+}
+
+// NewGasPolicy creates the GasPolicy of the gas configuration.  It returns nil
+// if no policy is configured.
+func NewGasPolicy(cfg *config.Gas) *GasPolicy {
+	if cfg.MaxGasPrice.Sign() == 0 && cfg.PriceMultiplier == 0 {
+		return nil
+	}
+	g := &GasPolicy{Multiplier: cfg.PriceMultiplier}
+	if g.Multiplier == 0 {
+		g.Multiplier = 1
+	}
+	if cfg.MaxGasPrice.Sign() != 0 {
+		g.MaxGasPrice = &cfg.MaxGasPrice.Int
+	}
+	return g
+}
+
+// GasPrice returns the gas price of the transactions for the suggested one.
+// Without policy (nil GasPolicy) it's the suggested one increased by 1%, like
+// eth.Client.CallAuth does.
+func (g *GasPolicy) GasPrice(suggested *big.Int) *big.Int {
+	if g == nil {
+		return new(big.Int).Add(suggested, new(big.Int).Div(suggested, big.NewInt(100)))
+	}
+	price, _ := new(big.Float).Mul(new(big.Float).SetInt(suggested),
+		big.NewFloat(g.Multiplier)).Int(nil)
+	return g.Cap(price)
+}
+
+// Cap returns the gas price limited to MaxGasPrice.
+func (g *GasPolicy) Cap(price *big.Int) *big.Int {
+	if g.MaxGasPrice != nil && price.Cmp(g.MaxGasPrice) == 1 {
+		return new(big.Int).Set(g.MaxGasPrice)
+	}
+	return price
+}
+
+// idenStatesGasLimit is the gas limit of the state transition transactions,
+// the one used by idenpubonchain.IdenPubOnChain.
+const idenStatesGasLimit = 1000000
+
+// suggestGasPrice returns the gas price of the state transition transactions
+// with gasPolicy for the one suggested by c.
+func suggestGasPrice(c *ethclient.Client, gasPolicy *GasPolicy) (*big.Int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	suggested, err := c.SuggestGasPrice(ctx)
+	if err != nil {
+		return nil, err
+	}
+	gasPrice := gasPolicy.GasPrice(suggested)
+	log.WithField("suggested", suggested).WithField("gasPrice", gasPrice).Debug("Gas price policy applied")
+	return gasPrice, nil
+}
+
+// gasIdenPubOnChain is an IdenPubOnChainer that sends the state transition
+// transactions with the gas price of the GasPolicy.
+type gasIdenPubOnChain struct {
+	idenpubonchain.IdenPubOnChainer
+	client     *eth.Client
+	ks         *ethkeystore.KeyStore
+	idenStates common.Address
+	gasPolicy  *GasPolicy
+}
+
+// transactOpts returns the options of a transaction of the client account
+// with the policy gas price.
+func (p *gasIdenPubOnChain) transactOpts(c *ethclient.Client) (*bind.TransactOpts, error) {
+	gasPrice, err := suggestGasPrice(c, p.gasPolicy)
+	if err != nil {
+		return nil, err
+	}
+	auth, err := bind.NewKeyStoreTransactor(p.ks, *p.client.Account())
+	if err != nil {
+		return nil, err
+	}
+	auth.Value = big.NewInt(0)
+	auth.GasLimit = idenStatesGasLimit
+	auth.GasPrice = gasPrice
+	return auth, nil
+}
+
+// transact sends the transaction made by fn with the policy gas price.
+func (p *gasIdenPubOnChain) transact(fn func(idenStates *contracts.State,
+	auth *bind.TransactOpts) (*types.Transaction, error)) (*types.Transaction, error) {
+	if p.client.Account() == nil {
+		return nil, eth.ErrAccountNil
+	}
+	var tx *types.Transaction
+	err := p.client.Call(func(c *ethclient.Client) error {
+		auth, err := p.transactOpts(c)
+		if err != nil {
+			return err
+		}
+		idenStates, err := contracts.NewState(p.idenStates, c)
+		if err != nil {
+			return err
+		}
+		tx, err = fn(idenStates, auth)
+		return err
+	})
+	if tx != nil {
+		log.WithField("tx", tx.Hash().Hex()).WithField("nonce", tx.Nonce()).Debug("Transaction")
+	}
+	return tx, err
+}
+
+func (p *gasIdenPubOnChain) InitState(id *core.ID, genesisState *merkletree.Hash,
+	newState *merkletree.Hash, proof *zktypes.Proof) (*types.Transaction, error) {
+	tx, err := p.transact(func(idenStates *contracts.State,
+		auth *bind.TransactOpts) (*types.Transaction, error) {
+		proofA, proofB, proofC := zkutils.ProofToBigInts(proof)
+		return idenStates.InitState(auth, newState.BigInt(), genesisState.BigInt(),
+			id.BigInt(), proofA, proofB, proofC)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed initalizating identity state in the Smart Contract (initState): %w", err)
+	}
+	return tx, nil
+}
+
+func (p *gasIdenPubOnChain) SetState(id *core.ID, newState *merkletree.Hash,
+	proof *zktypes.Proof) (*types.Transaction, error) {
+	tx, err := p.transact(func(idenStates *contracts.State,
+		auth *bind.TransactOpts) (*types.Transaction, error) {
+		proofA, proofB, proofC := zkutils.ProofToBigInts(proof)
+		return idenStates.SetState(auth, newState.BigInt(), id.BigInt(),
+			proofA, proofB, proofC)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed setting identity state in the Smart Contract (setState): %w", err)
+	}
+	return tx, nil
+}
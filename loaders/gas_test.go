@@ -0,0 +1,85 @@
+package loaders
+
+import (
+	"context"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	ethkeystore "github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/iden3/go-iden3-core/eth"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestEthClient returns a client of the web3 url with a new unlocked
+// account in a temporary keystore, removed by the returned function.
+func newTestEthClient(t *testing.T, url string) (*eth.Client, *ethkeystore.KeyStore, accounts.Account, func()) {
+	dir, err := ioutil.TempDir("", "keystore")
+	require.Nil(t, err)
+	ks := ethkeystore.NewKeyStore(dir, ethkeystore.LightScryptN, ethkeystore.LightScryptP)
+	acc, err := ks.NewAccount("pass")
+	require.Nil(t, err)
+	require.Nil(t, ks.Unlock(acc, "pass"))
+
+	var cfg config.Web3
+	cfg.Url = url
+	pool, err := NewWeb3Pool(&cfg)
+	require.Nil(t, err)
+	client := eth.NewClient(ethclient.NewClient(pool.Client()), &acc, ks)
+	return client, ks, acc, func() { os.RemoveAll(dir) }
+}
+
+func TestGasIdenPubOnChainPrice(t *testing.T) {
+	_, server := newSimBackend(t, 100)
+	defer server.Close()
+	client, ks, acc, remove := newTestEthClient(t, server.URL)
+	defer remove()
+
+	var gas config.Gas
+	gas.PriceMultiplier = 1.5
+	p := &gasIdenPubOnChain{client: client, ks: ks, gasPolicy: NewGasPolicy(&gas)}
+	require.Nil(t, client.Call(func(c *ethclient.Client) error {
+		auth, err := p.transactOpts(c)
+		require.Nil(t, err)
+		require.Equal(t, big.NewInt(15000000000), auth.GasPrice)
+		require.Equal(t, acc.Address, auth.From)
+
+		gas.MaxGasPrice.SetInt64(12000000000)
+		p.gasPolicy = NewGasPolicy(&gas)
+		auth, err = p.transactOpts(c)
+		require.Nil(t, err)
+		require.Equal(t, big.NewInt(12000000000), auth.GasPrice)
+
+		// The suggested gas price is not modified for other callers
+		gasPrice, err := c.SuggestGasPrice(context.Background())
+		require.Nil(t, err)
+		require.Equal(t, big.NewInt(10000000000), gasPrice)
+		return nil
+	}))
+}
+
+func TestEstimatePublishStateCost(t *testing.T) {
+	_, server := newSimBackend(t, 100)
+	defer server.Close()
+	client, _, _, remove := newTestEthClient(t, server.URL)
+	defer remove()
+
+	// Without policy, the 1% increase of eth.Client.CallAuth
+	s := &Server{EthClient: client}
+	cost, err := s.estimatePublishStateCost()
+	require.Nil(t, err)
+	require.Equal(t, new(big.Int).Mul(big.NewInt(10100000000), big.NewInt(idenStatesGasLimit)), cost)
+
+	// The price of the transactions sent with the policy
+	var gas config.Gas
+	gas.PriceMultiplier = 2
+	gas.MaxGasPrice.SetInt64(15000000000)
+	s.gasPolicy = NewGasPolicy(&gas)
+	cost, err = s.estimatePublishStateCost()
+	require.Nil(t, err)
+	require.Equal(t, new(big.Int).Mul(big.NewInt(15000000000), big.NewInt(idenStatesGasLimit)), cost)
+}
@@ -0,0 +1,237 @@
+package loaders
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/identity/issuer"
+	babykeystore "github.com/iden3/go-iden3-core/keystore"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+	"github.com/iden3/go-iden3-servers/config"
+)
+
+var (
+	// dbKeyHostedIdentities is the storage key of the identities created by
+	// the running server, hosted in addition to the configured ones.
+	dbKeyHostedIdentities    = []byte("hostedidentities")
+	dbKeyIssuerConfig        = []byte("config")
+	dbKeyIssuerKOp           = []byte("kop")
+	dbKeyIssuerGenesisClr    = []byte("genclr")
+	dbPrefixIssuerClaimsTree = []byte("treeclaims:")
+	dbPrefixIssuerRevTree    = []byte("treerevocation:")
+	dbPrefixIssuerRootsTree  = []byte("treeroots:")
+)
+
+// IdenStorage returns the storage of the identity id.
+func IdenStorage(storage db.Storage, id *core.ID) db.Storage {
+	return storage.WithPrefix([]byte(fmt.Sprintf("%v:", id)))
+}
+
+// LoadIdenState calculates the current state of the identity stored in
+// idenStorage from its merkle trees, without loading the issuer.
+func LoadIdenState(idenStorage db.Storage) (*merkletree.Hash, error) {
+	var cfg issuer.Config
+	if err := db.LoadJSON(idenStorage, dbKeyIssuerConfig, &cfg); err != nil {
+		return nil, fmt.Errorf("Error loading issuer config from storage: %w", err)
+	}
+	clt, err := merkletree.NewMerkleTree(idenStorage.WithPrefix(dbPrefixIssuerClaimsTree), cfg.MaxLevelsClaimsTree)
+	if err != nil {
+		return nil, err
+	}
+	ret, err := merkletree.NewMerkleTree(idenStorage.WithPrefix(dbPrefixIssuerRevTree), cfg.MaxLevelsRevocationTree)
+	if err != nil {
+		return nil, err
+	}
+	rot, err := merkletree.NewMerkleTree(idenStorage.WithPrefix(dbPrefixIssuerRootsTree), cfg.MaxLevelsRootsTree)
+	if err != nil {
+		return nil, err
+	}
+	return core.IdenState(clt.RootKey(), ret.RootKey(), rot.RootKey()), nil
+}
+
+// CreateIdentity creates an issuer with a new babyjub key kOp in memory.
+// Its id, the kOp secret key and an uncommitted transaction of storage with
+// its key values under the identity prefix are returned.  The transaction
+// also records the schema version if storage is empty.  Nothing is written
+// until the transaction is committed, and the key must be imported into the
+// babyjub keystore before that.
+func CreateIdentity(storage db.Storage, confirmBlocks uint64) (*core.ID, *babyjub.PrivateKey, db.Tx, error) {
+	sk := babyjub.NewRandPrivKey()
+	keyStore, err := babykeystore.NewKeyStore(&babykeystore.MemStorage{}, babykeystore.LightKeyStoreParams)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer keyStore.Close()
+	kOp, err := keyStore.ImportKey(sk, nil)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if err := keyStore.UnlockKey(kOp, nil); err != nil {
+		return nil, nil, nil, err
+	}
+
+	memStorage := db.NewMemoryStorage()
+	cfg := issuer.ConfigDefault
+	cfg.ConfirmBlocks = confirmBlocks
+	id, err := issuer.Create(cfg, kOp, nil, memStorage, keyStore)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Error creating issuer: %w", err)
+	}
+	tx, err := storage.NewTx()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	idenTx, err := IdenStorage(storage, id).NewTx()
+	if err != nil {
+		tx.Close()
+		return nil, nil, nil, err
+	}
+	defer idenTx.Close()
+	if err := memStorage.Iterate(func(k, v []byte) (bool, error) {
+		idenTx.Put(k, v)
+		return true, nil
+	}); err != nil {
+		tx.Close()
+		return nil, nil, nil, err
+	}
+	if err := initSchemaVersion(storage, tx); err != nil {
+		tx.Close()
+		return nil, nil, nil, err
+	}
+	tx.Add(idenTx)
+	return id, &sk, tx, nil
+}
+
+// LoadHostedIdentities returns the identities created by the running server.
+func LoadHostedIdentities(storage db.Storage) ([]config.HostedIdentity, error) {
+	var idens []config.HostedIdentity
+	if err := db.LoadJSON(storage, dbKeyHostedIdentities, &idens); errors.Is(err, db.ErrNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error loading hosted identities: %w", err)
+	}
+	return idens, nil
+}
+
+// LoadAllHostedIdentities returns the identities hosted by the issuer of
+// cfg: the configured ones followed by the ones created at runtime and
+// stored in storage.
+func LoadAllHostedIdentities(cfg *config.Config, storage db.Storage) ([]config.HostedIdentity, error) {
+	cfgIdens, err := cfg.HostedIdentities()
+	if err != nil {
+		return nil, err
+	}
+	hosted, err := LoadHostedIdentities(storage)
+	if err != nil {
+		return nil, err
+	}
+	for _, cfgIden := range hosted {
+		configured := false
+		for i := range cfgIdens {
+			configured = configured || cfgIdens[i].Id == cfgIden.Id
+		}
+		if !configured {
+			cfg.SetHostedIdentityDefaults(&cfgIden)
+			cfgIdens = append(cfgIdens, cfgIden)
+		}
+	}
+	return cfgIdens, nil
+}
+
+// CheckGenesis checks that the identity stored in idenStorage is cfgIden.
+// The genesis state is recomputed from the claims of the stored genesis
+// claims tree and must derive the configured Id, and the configured kOp must
+// be the stored one, authorized in the current claims tree and not revoked.
+func CheckGenesis(idenStorage db.Storage, cfgIden *config.Identity) error {
+	var cfg issuer.Config
+	if err := db.LoadJSON(idenStorage, dbKeyIssuerConfig, &cfg); errors.Is(err, db.ErrNotFound) {
+		return fmt.Errorf("Identity %v not found in storage", &cfgIden.Id)
+	} else if err != nil {
+		return fmt.Errorf("Error loading issuer config of identity %v from storage: %w", &cfgIden.Id, err)
+	}
+	var genesisClr merkletree.Hash
+	if err := db.LoadJSON(idenStorage, dbKeyIssuerGenesisClr, &genesisClr); err != nil {
+		return fmt.Errorf("Error loading genesis claims tree root of identity %v from storage: %w",
+			&cfgIden.Id, err)
+	}
+	clt, err := merkletree.NewMerkleTree(idenStorage.WithPrefix(dbPrefixIssuerClaimsTree), cfg.MaxLevelsClaimsTree)
+	if err != nil {
+		return err
+	}
+	ret, err := merkletree.NewMerkleTree(idenStorage.WithPrefix(dbPrefixIssuerRevTree), cfg.MaxLevelsRevocationTree)
+	if err != nil {
+		return err
+	}
+
+	// Recompute the genesis state from the genesis claims
+	genesisClt, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), cfg.MaxLevelsClaimsTree)
+	if err != nil {
+		return err
+	}
+	var walkErr error
+	if err := clt.Walk(&genesisClr, func(n *merkletree.Node) {
+		if n.Type == merkletree.NodeTypeLeaf && walkErr == nil {
+			walkErr = genesisClt.AddEntry(n.Entry)
+		}
+	}); err != nil {
+		return fmt.Errorf("Error reading genesis claims of identity %v: %w", &cfgIden.Id, err)
+	}
+	if walkErr != nil {
+		return fmt.Errorf("Error adding genesis claims of identity %v: %w", &cfgIden.Id, walkErr)
+	}
+	if !genesisClt.RootKey().Equals(&genesisClr) {
+		return fmt.Errorf("Genesis claims of identity %v have root %v, but the stored genesis root is %v",
+			&cfgIden.Id, genesisClt.RootKey().Hex(), genesisClr.Hex())
+	}
+	genesisRot, err := merkletree.NewMerkleTree(db.NewMemoryStorage(), cfg.MaxLevelsRootsTree)
+	if err != nil {
+		return err
+	}
+	if err := claims.AddLeafRootsTree(genesisRot, &genesisClr); err != nil {
+		return err
+	}
+	genesisState := core.IdenState(&genesisClr, &merkletree.HashZero, genesisRot.RootKey())
+	if id := core.IdGenesisFromIdenState(genesisState); *id != cfgIden.Id {
+		return fmt.Errorf("Stored genesis state %v derives identity %v, but the configured Identity.Id is %v",
+			genesisState.Hex(), id, &cfgIden.Id)
+	}
+
+	kOp := cfgIden.Keys.BabyJub.KOp.Compress()
+	storedKOp, err := idenStorage.Get(dbKeyIssuerKOp)
+	if err != nil {
+		return fmt.Errorf("Error loading kOp of identity %v from storage: %w", &cfgIden.Id, err)
+	}
+	if !bytes.Equal(storedKOp, kOp[:]) {
+		return fmt.Errorf("Configured kOp %v of identity %v doesn't match the stored kOp %x",
+			&kOp, &cfgIden.Id, storedKOp)
+	}
+	claimKOp := claims.NewClaimKeyBabyJub(&cfgIden.Keys.BabyJub.KOp, claims.BabyJubKeyTypeAuthorizeKSign)
+	hi, err := claimKOp.Entry().HIndex()
+	if err != nil {
+		return err
+	}
+	data, err := clt.GetDataByIndex(hi)
+	if errors.Is(err, merkletree.ErrEntryIndexNotFound) {
+		return fmt.Errorf("Configured kOp %v is not authorized in the claims tree of identity %v",
+			&kOp, &cfgIden.Id)
+	} else if err != nil {
+		return err
+	}
+	nonce := claims.GetRevocationNonce(&merkletree.Entry{Data: *data})
+	revHi, err := claims.NewLeafRevocationsTree(nonce, 0).Entry().HIndex()
+	if err != nil {
+		return err
+	}
+	if _, err := ret.GetDataByIndex(revHi); err == nil {
+		return fmt.Errorf("Configured kOp %v of identity %v is revoked (revocation nonce %v)",
+			&kOp, &cfgIden.Id, nonce)
+	} else if !errors.Is(err, merkletree.ErrEntryIndexNotFound) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package loaders
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/core/claims"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/identity/issuer"
+	babykeystore "github.com/iden3/go-iden3-core/keystore"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCreateIdentity(t *testing.T) {
+	storage := db.NewMemoryStorage()
+
+	hosted, err := LoadHostedIdentities(storage)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(hosted))
+
+	id, sk, tx, err := CreateIdentity(storage, 10)
+	require.Nil(t, err)
+	kOp := sk.Public().Compress()
+
+	// Nothing is written before the commit
+	n := 0
+	require.Nil(t, storage.Iterate(func(k, v []byte) (bool, error) {
+		n++
+		return true, nil
+	}))
+	require.Equal(t, 0, n)
+	require.Nil(t, tx.Commit())
+
+	idenStorage := IdenStorage(storage, id)
+	storedKOp, err := idenStorage.Get([]byte("kop"))
+	require.Nil(t, err)
+	require.True(t, bytes.Equal(kOp[:], storedKOp))
+	_, err = LoadIdenState(idenStorage)
+	require.Nil(t, err)
+}
+
+func TestCheckGenesis(t *testing.T) {
+	storage := db.NewMemoryStorage()
+	id, sk, tx, err := CreateIdentity(storage, 10)
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+	kOp := sk.Public()
+	idenStorage := IdenStorage(storage, id)
+
+	var cfgIden config.Identity
+	cfgIden.Id = *id
+	cfgIden.Keys.BabyJub.KOp = *kOp
+	require.Nil(t, CheckGenesis(idenStorage, &cfgIden))
+
+	cfgIden.Id = core.ID{}
+	err = CheckGenesis(IdenStorage(storage, &cfgIden.Id), &cfgIden)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "not found in storage")
+
+	// Config of another identity
+	id1, sk1, tx, err := CreateIdentity(storage, 10)
+	require.Nil(t, err)
+	require.Nil(t, tx.Commit())
+	cfgIden.Id = *id1
+	err = CheckGenesis(idenStorage, &cfgIden)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "derives identity "+id.String())
+
+	cfgIden.Id = *id
+	cfgIden.Keys.BabyJub.KOp = *sk1.Public()
+	err = CheckGenesis(idenStorage, &cfgIden)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "doesn't match the stored kOp")
+
+	// Revoked kOp
+	cfgIden.Keys.BabyJub.KOp = *kOp
+	var cfg issuer.Config
+	require.Nil(t, db.LoadJSON(idenStorage, dbKeyIssuerConfig, &cfg))
+	clt, err := merkletree.NewMerkleTree(idenStorage.WithPrefix(dbPrefixIssuerClaimsTree), cfg.MaxLevelsClaimsTree)
+	require.Nil(t, err)
+	ret, err := merkletree.NewMerkleTree(idenStorage.WithPrefix(dbPrefixIssuerRevTree), cfg.MaxLevelsRevocationTree)
+	require.Nil(t, err)
+	hi, err := claims.NewClaimKeyBabyJub(kOp, claims.BabyJubKeyTypeAuthorizeKSign).Entry().HIndex()
+	require.Nil(t, err)
+	data, err := clt.GetDataByIndex(hi)
+	require.Nil(t, err)
+	nonce := claims.GetRevocationNonce(&merkletree.Entry{Data: *data})
+	require.Nil(t, claims.AddLeafRevocationsTree(ret, nonce, 0xffffffff))
+	err = CheckGenesis(idenStorage, &cfgIden)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "is revoked")
+}
+
+type failCommitStorage struct {
+	db.Storage
+}
+
+func (s *failCommitStorage) NewTx() (db.Tx, error) {
+	tx, err := s.Storage.NewTx()
+	return &failCommitTx{tx}, err
+}
+
+type failCommitTx struct {
+	db.Tx
+}
+
+func (tx *failCommitTx) Commit() error {
+	tx.Tx.Close()
+	return errors.New("commit failed")
+}
+
+func TestServerCreateIdentityRollback(t *testing.T) {
+	keyStoreStorage := &babykeystore.MemStorage{}
+	ksStorage := newKeyStoreBabyStorage(keyStoreStorage)
+	ks, err := babykeystore.NewKeyStore(ksStorage, babykeystore.LightKeyStoreParams)
+	require.Nil(t, err)
+	kOp0, err := ks.NewKey([]byte("pass"))
+	require.Nil(t, err)
+	cfg := &config.Config{}
+	cfg.KeyStoreBaby.Password.Value = "pass"
+	cfg.Issuer.ConfirmBlocks = 10
+	storage := db.NewMemoryStorage()
+	s := &Server{Cfg: cfg, Storage: &failCommitStorage{storage}, KeyStoreBaby: ks,
+		keyStoreBabyStorage: ksStorage}
+
+	// Neither the identity nor its key are left behind
+	_, err = s.CreateIdentity()
+	require.Error(t, err)
+	hosted, err := LoadHostedIdentities(storage)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(hosted))
+	var keys babykeystore.KeysStored
+	require.Nil(t, json.Unmarshal(*keyStoreStorage, &keys))
+	require.Equal(t, 1, len(keys))
+	require.Contains(t, keys, *kOp0)
+
+	// Not even after the keystore writes all its keys again
+	kOp1, err := ks.NewKey([]byte("pass"))
+	require.Nil(t, err)
+	keys = nil
+	require.Nil(t, json.Unmarshal(*keyStoreStorage, &keys))
+	require.Equal(t, 2, len(keys))
+	require.Contains(t, keys, *kOp1)
+}
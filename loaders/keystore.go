@@ -0,0 +1,64 @@
+package loaders
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	babykeystore "github.com/iden3/go-iden3-core/keystore"
+	"github.com/iden3/go-iden3-crypto/babyjub"
+)
+
+// keyStoreBabyStorage is the storage of a babyjub keystore that can remove
+// keys.  The keystore keeps its keys in memory and writes all of them on
+// every import, so the removed keys are also dropped from its later writes.
+type keyStoreBabyStorage struct {
+	babykeystore.Storage
+	mutex   sync.Mutex
+	removed map[babyjub.PublicKeyComp]bool
+}
+
+func newKeyStoreBabyStorage(storage babykeystore.Storage) *keyStoreBabyStorage {
+	return &keyStoreBabyStorage{Storage: storage, removed: make(map[babyjub.PublicKeyComp]bool)}
+}
+
+// Write writes the keys of the keystore without the removed ones.
+func (s *keyStoreBabyStorage) Write(data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.write(data)
+}
+
+func (s *keyStoreBabyStorage) write(data []byte) error {
+	if len(s.removed) == 0 {
+		return s.Storage.Write(data)
+	}
+	var keys babykeystore.KeysStored
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return err
+	}
+	for pk := range s.removed {
+		delete(keys, pk)
+	}
+	data, err := json.Marshal(keys)
+	if err != nil {
+		return err
+	}
+	return s.Storage.Write(data)
+}
+
+// RemoveKey removes the key pk from the storage.  The keystore can still use
+// the key until it's reloaded.
+func (s *keyStoreBabyStorage) RemoveKey(pk *babyjub.PublicKeyComp) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.removed[*pk] = true
+	data, err := s.Storage.Read()
+	if err != nil {
+		return err
+	}
+	if err := s.write(data); err != nil {
+		return fmt.Errorf("Error removing babyjub key %v from keystore: %w", pk, err)
+	}
+	return nil
+}
@@ -1,14 +1,18 @@
 package loaders
 
 import (
+	"context"
 	"fmt"
-	"strings"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/accounts"
 	ethkeystore "github.com/ethereum/go-ethereum/accounts/keystore"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethclient"
+	zktypes "github.com/iden3/go-circom-prover-verifier/types"
 	"github.com/iden3/go-iden3-core/components/idenpuboffchain"
 	idenpuboffchainwriterhttp "github.com/iden3/go-iden3-core/components/idenpuboffchain/writerhttp"
 	"github.com/iden3/go-iden3-core/components/idenpubonchain"
@@ -18,8 +22,10 @@ import (
 	"github.com/iden3/go-iden3-core/identity/issuer"
 	babykeystore "github.com/iden3/go-iden3-core/keystore"
 	"github.com/iden3/go-iden3-core/merkletree"
+	zkutils "github.com/iden3/go-iden3-core/utils/zk"
 	"github.com/iden3/go-iden3-crypto/babyjub"
 	"github.com/iden3/go-iden3-servers/config"
+	"github.com/iden3/go-iden3-servers/zkfiles"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -57,49 +63,75 @@ func LoadKeyStore(cfgKeyStore *config.KeyStore, accountAddr *common.Address) (*e
 }
 
 func LoadKeyStoreBabyJub(cfgKeyStore *config.KeyStore, kOp *babyjub.PublicKey) (*babykeystore.KeyStore, error) {
-	storage := babykeystore.NewFileStorage(cfgKeyStore.Path)
+	ks, _, err := loadKeyStoreBabyJub(cfgKeyStore, kOp)
+	return ks, err
+}
+
+func loadKeyStoreBabyJub(cfgKeyStore *config.KeyStore,
+	kOp *babyjub.PublicKey) (*babykeystore.KeyStore, *keyStoreBabyStorage, error) {
+	storage := newKeyStoreBabyStorage(babykeystore.NewFileStorage(cfgKeyStore.Path))
 	ks, err := babykeystore.NewKeyStore(storage, babykeystore.StandardKeyStoreParams)
 	if err != nil {
-		return nil, fmt.Errorf("Error creating/opening babyjub keystore: %w", err)
+		return nil, nil, fmt.Errorf("Error creating/opening babyjub keystore: %w", err)
 	}
 	if kOp != nil {
-		kOpComp := kOp.Compress()
-		if err := ks.UnlockKey(&kOpComp, []byte(cfgKeyStore.Password.Value)); err != nil {
-			return nil, fmt.Errorf("Error unlocking babyjub key from keystore: %w", err)
+		if err := unlockKeyBabyJub(ks, cfgKeyStore, kOp); err != nil {
+			return nil, nil, err
 		}
-		log.WithField("kOp", kOpComp.String()).Info("Babyjub Keystore and key unlocked successfully")
-		return ks, nil
-	} else {
-		return ks, nil
 	}
+	return ks, storage, nil
 }
 
-func LoadEthClient(ks *ethkeystore.KeyStore, acc *accounts.Account, web3Url string) (*eth.Client, error) {
-	// TODO: Handle the hidden: thing with a custon configuration type
-	hidden := strings.HasPrefix(web3Url, "hidden:")
-	if hidden {
-		web3Url = web3Url[len("hidden:"):]
+// LoadZkFiles downloads the missing zk files from their sources, verifying
+// their hashes, and loads them.
+func LoadZkFiles(cfg *config.ZkFiles) (*zkutils.ZkFiles, error) {
+	zkFiles := cfg.Value()
+	downloader := zkfiles.NewDownloader(cfg.Sources()...)
+	downloader.Progress = zkfiles.LogProgress(10 * time.Second)
+	hashes := zkutils.ZkFilesHashes{
+		ProvingKey:      cfg.Hashes.ProvingKey,
+		VerificationKey: cfg.Hashes.VerificationKey,
+		WitnessCalcWASM: cfg.Hashes.WitnessCalcWASM,
 	}
-	client, err := ethclient.Dial(web3Url)
-	if err != nil {
-		return nil, fmt.Errorf("Error dialing with ethclient: %w", err)
+	if err := downloader.Download(cfg.Path, zkfiles.Files(cfg.ProvingKeyFormat, &hashes)); err != nil {
+		return nil, err
 	}
-	if hidden {
-		log.WithField("url", "(hidden)").Info("Connection to web3 server opened")
-	} else {
-		log.WithField("url", web3Url).Info("Connection to web3 server opened")
+	if err := zkFiles.LoadAll(); err != nil {
+		return nil, err
 	}
+	return zkFiles, nil
+}
+
+func LoadEthClient(ks *ethkeystore.KeyStore, acc *accounts.Account, web3 *Web3Pool) (*eth.Client, error) {
+	client := ethclient.NewClient(web3.Client())
+	log.WithField("url", web3.Current()).Info("Connection to web3 server opened")
 	return eth.NewClient(client, acc, ks), nil
 }
 
-func LoadStorage(storagePath string) (db.Storage, error) {
-	// Open database
-	storage, err := db.NewLevelDbStorage(storagePath, false)
-	if err != nil {
-		return nil, fmt.Errorf("Error opening leveldb storage: %w", err)
+// CheckContract checks that the contract is deployed at its address and, if
+// the expected CodeHash is set, that the deployed bytecode matches it.
+func CheckContract(ethClient *eth.Client, name string, contract *config.Contract) error {
+	var code []byte
+	if err := ethClient.Call(func(c *ethclient.Client) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var err error
+		code, err = c.CodeAt(ctx, contract.Address, nil)
+		return err
+	}); err != nil {
+		return fmt.Errorf("Error getting %v contract bytecode: %w", name, err)
 	}
-	log.WithField("path", storagePath).Info("Storage opened")
-	return storage, nil
+	if len(code) == 0 {
+		return fmt.Errorf("No %v contract bytecode found at %v", name, contract.Address.Hex())
+	}
+	if contract.CodeHash != (common.Hash{}) {
+		if codeHash := crypto.Keccak256Hash(code); codeHash != contract.CodeHash {
+			return fmt.Errorf("%v contract bytecode hash at %v is %v, but %v was expected",
+				name, contract.Address.Hex(), codeHash.Hex(), contract.CodeHash.Hex())
+		}
+	}
+	log.WithField("address", contract.Address.Hex()).Infof("%v contract checked successfully", name)
+	return nil
 }
 
 func LoadIdenPubOffChainWriteHttp(storage db.Storage, id *core.ID,
@@ -115,8 +147,7 @@ func LoadIssuer(id *core.ID, storage db.Storage, keyStore *babykeystore.KeyStore
 	idenStateZkProofConf *issuer.IdenStateZkProofConf,
 	idenPubOffChainWrite idenpuboffchain.IdenPubOffChainWriter) (*issuer.Issuer, error) {
 
-	idenStorage := storage.WithPrefix([]byte(fmt.Sprintf("%v:", id)))
-	is, err := issuer.Load(idenStorage, keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChainWrite)
+	is, err := issuer.Load(IdenStorage(storage, id), keyStore, idenPubOnChain, idenStateZkProofConf, idenPubOffChainWrite)
 	if err != nil {
 		return nil, fmt.Errorf("Error loading issuer: %w", err)
 	}
@@ -124,122 +155,396 @@ func LoadIssuer(id *core.ID, storage db.Storage, keyStore *babykeystore.KeyStore
 	return is, nil
 }
 
+// serialIdenPubOnChain is an IdenPubOnChainer that sends the state
+// transitions one at a time.  The identities share the ethereum account, so
+// concurrent sends would race for the nonce.
+type serialIdenPubOnChain struct {
+	idenpubonchain.IdenPubOnChainer
+	mutex sync.Mutex
+}
+
+func (p *serialIdenPubOnChain) InitState(id *core.ID, genesisState *merkletree.Hash,
+	newState *merkletree.Hash, proof *zktypes.Proof) (*types.Transaction, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.IdenPubOnChainer.InitState(id, genesisState, newState, proof)
+}
+
+func (p *serialIdenPubOnChain) SetState(id *core.ID, newState *merkletree.Hash,
+	proof *zktypes.Proof) (*types.Transaction, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.IdenPubOnChainer.SetState(id, newState, proof)
+}
+
+// Identity is an identity hosted by the Server, with its own issuer,
+// off-chain publisher and publish and sync loops.
+type Identity struct {
+	Cfg                      *config.HostedIdentity
+	loopMutex                sync.Mutex
+	Issuer                   *issuer.Issuer
+	IdenPubOffChainWriteHttp *idenpuboffchainwriterhttp.IdenPubOffChainWriteHttp
+	TxWatchdog               *TxWatchdog
+}
+
+// WithLoopsPaused runs fn while the publish and sync loops of the identity
+// are paused at a safe point, so that fn sees an identity storage without
+// ongoing state changes.
+func (iden *Identity) WithLoopsPaused(fn func() error) error {
+	iden.loopMutex.Lock()
+	defer iden.loopMutex.Unlock()
+	return fn()
+}
+
 type Server struct {
-	Cfg                      *config.Config
-	stopchPublish            chan (interface{})
-	stoppedchPublish         chan (interface{})
-	stopchSync               chan (interface{})
-	stoppedchSync            chan (interface{})
-	Id                       core.ID
-	Mt                       *merkletree.MerkleTree
+	Cfg         *config.Config
+	rw          sync.RWMutex
+	createMutex sync.Mutex
+	funds       *Funds
+	started     bool
+	stopch      chan (interface{})
+	stopped     sync.WaitGroup
+	ks          *ethkeystore.KeyStore
+	chainId     uint64
+	gasPolicy   *GasPolicy
+	zkFiles     *zkutils.ZkFiles
+	Id          core.ID
+	Mt          *merkletree.MerkleTree
+	// Prover runs the state transitions, which generate the zk proofs, of
+	// the publish loops
+	Prover *Prover
+	// Issuer, IdenPubOffChainWriteHttp, TxWatchdog and KOp are the ones of
+	// the main identity, the first of Identities()
 	Issuer                   *issuer.Issuer
+	idens                    []*Identity
+	identities               map[core.ID]*Identity
+	Storage                  db.Storage
 	IdenPubOnChain           idenpubonchain.IdenPubOnChainer
 	IdenPubOffChainWriteHttp *idenpuboffchainwriterhttp.IdenPubOffChainWriteHttp
 	KeyStore                 *ethkeystore.KeyStore
 	KeyStoreBaby             *babykeystore.KeyStore
+	keyStoreBabyStorage      *keyStoreBabyStorage
 	EthClient                *eth.Client
+	Web3Pool                 *Web3Pool
+	TxWatchdog               *TxWatchdog
 	KOp                      *babyjub.PublicKey
 }
 
+// Identity returns the hosted identity id, or nil if it's not hosted.
+func (s *Server) Identity(id *core.ID) *Identity {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	return s.identities[*id]
+}
+
+// Identities returns the hosted identities, starting with the main one.
+func (s *Server) Identities() []*Identity {
+	s.rw.RLock()
+	defer s.rw.RUnlock()
+	return append([]*Identity{}, s.idens...)
+}
+
+// addIdentity hosts the identity, starting its loops if the server is
+// started.
+func (s *Server) addIdentity(iden *Identity) {
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.idens = append(s.idens, iden)
+	s.identities[*iden.Issuer.ID()] = iden
+	if s.started {
+		s.startLoops(iden)
+	}
+}
+
 func (s *Server) Start() error {
 	log.Info("Starting Issuer Server")
+	s.Web3Pool.Start()
+	if err := s.Prover.Start(); err != nil {
+		return err
+	}
+	s.rw.Lock()
+	defer s.rw.Unlock()
+	s.started = true
+	for _, iden := range s.idens {
+		s.startLoops(iden)
+	}
+	return nil
+}
+
+func (s *Server) startLoops(iden *Identity) {
+	s.startLoop(iden, "PublishState", iden.Cfg.PublishStatePeriod.Duration, s.publishState)
+	s.startLoop(iden, "SyncIdenStatePublic", iden.Cfg.SyncIdenStatePublicPeriod.Duration,
+		s.syncIdenStatePublic)
+}
+
+// startLoop runs fn for the identity every period until the server is
+// stopped.
+func (s *Server) startLoop(iden *Identity, name string, period time.Duration, fn func(iden *Identity)) {
+	s.stopped.Add(1)
 	go func() {
-		log.Info("Starting periodic Issuer PublishState")
-		for {
-			select {
-			case <-s.stopchPublish:
-				log.Info("Issuer server finalized")
-				s.stoppedchPublish <- nil
-				return
-			case <-time.After(s.Cfg.Issuer.PublishStatePeriod.Duration):
-				log.Debug("Issuer.PublishState()...")
-				if err := s.Issuer.PublishState(); err != nil {
-					if err != issuer.ErrIdenStatePendingNotNil {
-						log.WithField("err", err).Error("Issuer.PublishState")
-					}
-				}
-				state, _ := s.Issuer.State()
-				onchain := s.Issuer.IdenStateOnChain()
-				pending, transacted := s.Issuer.IdenStatePending()
-				log.WithField("state", state).WithField("onchain", onchain).
-					WithField("pending", pending).
-					WithField("txed", transacted).
-					Debug("Issuer.PublishState()")
-			}
-		}
-	}()
-	go func() {
-		log.Info("Starting periodic Issuer SyncIdenStatePublic")
+		defer s.stopped.Done()
+		log.WithField("id", iden.Issuer.ID()).Infof("Starting periodic Issuer %v", name)
 		for {
 			select {
-			case <-s.stopchSync:
-				log.Info("Issuer server finalized")
-				s.stoppedchSync <- nil
+			case <-s.stopch:
+				log.WithField("id", iden.Issuer.ID()).Infof("Issuer %v finalized", name)
 				return
-			case <-time.After(s.Cfg.Issuer.SyncIdenStatePublicPeriod.Duration):
-				log.Debug("Issuer.SyncIdenStatePublic()...")
-				if err := s.Issuer.SyncIdenStatePublic(); err != nil {
-					log.WithField("err", err).Error("Issuer.SyncIdenStatePublicPeriod")
-				}
-				state, _ := s.Issuer.State()
-				pending, transacted := s.Issuer.IdenStatePending()
-				onchain := s.Issuer.IdenStateOnChain()
-				log.WithField("state", state).WithField("onchain", onchain).
-					WithField("pending", pending).
-					WithField("txed", transacted).
-					Debug("Issuer.SyncIdenStatePublic()")
+			case <-time.After(period):
+				fn(iden)
 			}
 		}
 	}()
+}
+
+// publishState runs an iteration of the publish loop of the identity,
+// waiting for its state transition in the Prover.
+func (s *Server) publishState(iden *Identity) {
+	logger := log.WithField("id", iden.Issuer.ID())
+	if funds, err := s.CheckFunds(); err != nil {
+		logger.WithField("err", err).Error("CheckFunds")
+	} else if !funds.Enough {
+		logger.Warn("Issuer.PublishState() paused until the account has enough funds")
+		return
+	}
+	logger.Debug("Issuer.PublishState()...")
+	if err := s.Prover.Prove(iden.Issuer.ID()); err != nil && err != ErrProverStopped {
+		logger.WithField("err", err).Error("Issuer.PublishState")
+	}
+	state, _ := iden.Issuer.State()
+	onchain := iden.Issuer.IdenStateOnChain()
+	pending, transacted := iden.Issuer.IdenStatePending()
+	logger.WithField("state", state).WithField("onchain", onchain).
+		WithField("pending", pending).
+		WithField("txed", transacted).
+		Debug("Issuer.PublishState()")
+}
+
+// runPublishState is the ProofFunc of the Prover.  The issuer generates the
+// proof of the state transition within PublishState, so a job can only be
+// cancelled before it starts.
+func (s *Server) runPublishState(ctx context.Context, id *core.ID) error {
+	iden := s.Identity(id)
+	if iden == nil {
+		return fmt.Errorf("Identity %v not hosted", id)
+	}
+	iden.loopMutex.Lock()
+	defer iden.loopMutex.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := iden.Issuer.PublishState(); err != nil && err != issuer.ErrIdenStatePendingNotNil {
+		return err
+	}
 	return nil
 }
 
+// syncIdenStatePublic runs an iteration of the sync loop of the identity.
+func (s *Server) syncIdenStatePublic(iden *Identity) {
+	iden.loopMutex.Lock()
+	defer iden.loopMutex.Unlock()
+	logger := log.WithField("id", iden.Issuer.ID())
+	if _, transacted := iden.Issuer.IdenStatePending(); transacted && iden.TxWatchdog != nil {
+		if err := iden.TxWatchdog.Check(); err != nil {
+			logger.WithField("err", err).Error("TxWatchdog.Check")
+		}
+	}
+	logger.Debug("Issuer.SyncIdenStatePublic()...")
+	if err := iden.Issuer.SyncIdenStatePublic(); err != nil {
+		logger.WithField("err", err).Error("Issuer.SyncIdenStatePublicPeriod")
+	}
+	state, _ := iden.Issuer.State()
+	pending, transacted := iden.Issuer.IdenStatePending()
+	onchain := iden.Issuer.IdenStateOnChain()
+	logger.WithField("state", state).WithField("onchain", onchain).
+		WithField("pending", pending).
+		WithField("txed", transacted).
+		Debug("Issuer.SyncIdenStatePublic()")
+}
+
+// WithLoopsPaused runs fn while the publish and sync loops of all the
+// identities are paused at a safe point, so that fn sees a storage without
+// ongoing state changes.
+func (s *Server) WithLoopsPaused(fn func() error) error {
+	for _, iden := range s.Identities() {
+		iden.loopMutex.Lock()
+		defer iden.loopMutex.Unlock()
+	}
+	return fn()
+}
+
 func (s *Server) StopAndJoin() {
-	go func() {
-		s.stopchPublish <- nil
-		s.stopchSync <- nil
-	}()
-	<-s.stoppedchPublish
-	<-s.stoppedchSync
+	s.rw.Lock()
+	s.started = false
+	close(s.stopch)
+	s.rw.Unlock()
+	s.Prover.StopAndJoin()
+	s.stopped.Wait()
+	s.Web3Pool.StopAndJoin()
 }
 
-func LoadServer(cfg *config.Config) (*Server, error) {
-	ks, acc, err := LoadKeyStore(&cfg.KeyStore, &cfg.Account.Address)
+// unlockKeyBabyJub unlocks the babyjub key kOp of the keystore.
+func unlockKeyBabyJub(ks *babykeystore.KeyStore, cfgKeyStore *config.KeyStore, kOp *babyjub.PublicKey) error {
+	kOpComp := kOp.Compress()
+	if err := ks.UnlockKey(&kOpComp, []byte(cfgKeyStore.Password.Value)); err != nil {
+		return fmt.Errorf("Error unlocking babyjub key from keystore: %w", err)
+	}
+	log.WithField("kOp", kOpComp.String()).Info("Babyjub Keystore and key unlocked successfully")
+	return nil
+}
+
+// LoadIdentity loads the hosted identity cfgIden from the storage of the
+// server, after checking its genesis.
+func (s *Server) LoadIdentity(cfgIden *config.HostedIdentity) (*Identity, error) {
+	id := &cfgIden.Id
+	if err := CheckGenesis(IdenStorage(s.Storage, id), &cfgIden.Identity); err != nil {
+		return nil, err
+	}
+	iden := &Identity{Cfg: cfgIden}
+	idenPubOnChain := s.IdenPubOnChain
+	if s.Cfg.Gas.StuckBlocks != 0 {
+		var err error
+		iden.TxWatchdog, err = NewTxWatchdog(s.IdenPubOnChain, s.EthClient, s.ks,
+			s.chainId, &s.Cfg.Gas, s.gasPolicy,
+			s.Storage.WithPrefix([]byte(fmt.Sprintf("%v:txwatchdog:", id))))
+		if err != nil {
+			return nil, err
+		}
+		idenPubOnChain = iden.TxWatchdog
+	}
+	var err error
+	iden.IdenPubOffChainWriteHttp, err = LoadIdenPubOffChainWriteHttp(s.Storage, id,
+		cfgIden.IdenPubOffChain.Http.Url)
 	if err != nil {
 		return nil, err
 	}
-	kOp := &cfg.Identity.Keys.BabyJub.KOp
-	ksBaby, err := LoadKeyStoreBabyJub(&cfg.KeyStoreBaby, kOp)
+	iden.Issuer, err = LoadIssuer(id, s.Storage, s.KeyStoreBaby, idenPubOnChain,
+		&issuer.IdenStateZkProofConf{Levels: s.Cfg.IdenStateZKProof.Levels, Files: *s.zkFiles},
+		iden.IdenPubOffChainWriteHttp)
+	if err != nil {
+		return nil, err
+	}
+	return iden, nil
+}
+
+// CreateIdentity creates an identity with a new babyjub key kOp in
+// KeyStoreBaby and hosts it without restarting the server.  The identity is
+// stored together with the list of hosted identities, so that it's hosted
+// again after a restart.
+func (s *Server) CreateIdentity() (*Identity, error) {
+	s.createMutex.Lock()
+	defer s.createMutex.Unlock()
+	id, sk, tx, err := CreateIdentity(s.Storage, s.Cfg.Issuer.ConfirmBlocks)
 	if err != nil {
 		return nil, err
 	}
-	ethClient, err := LoadEthClient(ks, acc, cfg.Web3.Url)
+	defer tx.Close()
+	kOp := sk.Public()
+	cfgIden := config.HostedIdentity{Identity: config.Identity{Id: *id}}
+	cfgIden.Keys.BabyJub.KOp = *kOp
+	hosted, err := LoadHostedIdentities(s.Storage)
 	if err != nil {
 		return nil, err
 	}
+	if err := db.StoreJSON(tx, dbKeyHostedIdentities, append(hosted, cfgIden)); err != nil {
+		return nil, err
+	}
 
-	idenPubOnChain := idenpubonchain.New(ethClient, idenpubonchain.ContractAddresses{
-		IdenStates: cfg.Contracts.IdenStates.Address,
-	})
-	storage, err := LoadStorage(cfg.Storage.Path)
+	// The key is removed from the keystore if the identity can't be stored,
+	// so that on any error neither is left behind
+	password := []byte(s.Cfg.KeyStoreBaby.Password.Value)
+	kOpComp := kOp.Compress()
+	rollback := func() {
+		if err := s.keyStoreBabyStorage.RemoveKey(&kOpComp); err != nil {
+			log.WithError(err).Error("Error rolling back babyjub key import")
+		}
+	}
+	if _, err := s.KeyStoreBaby.ImportKey(*sk, password); err != nil {
+		rollback()
+		return nil, fmt.Errorf("Error importing babyjub key: %w", err)
+	}
+	if err := s.KeyStoreBaby.UnlockKey(&kOpComp, password); err != nil {
+		rollback()
+		return nil, fmt.Errorf("Error unlocking babyjub key: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		rollback()
+		return nil, fmt.Errorf("Error storing identity: %w", err)
+	}
+
+	s.Cfg.SetHostedIdentityDefaults(&cfgIden)
+	iden, err := s.LoadIdentity(&cfgIden)
 	if err != nil {
 		return nil, err
 	}
+	s.addIdentity(iden)
+	log.WithField("id", id).WithField("kOp", &kOpComp).Info("Identity created")
+	return iden, nil
+}
 
-	idenPubOffChainWriteHttp, err := LoadIdenPubOffChainWriteHttp(storage, &cfg.Identity.Id,
-		cfg.IdenPubOffChain.Http.Url)
+func LoadServer(cfg *config.Config) (_ *Server, err error) {
+	ks, acc, err := LoadKeyStore(&cfg.KeyStore, &cfg.Account.Address)
 	if err != nil {
 		return nil, err
 	}
+	kOp := &cfg.Identity.Keys.BabyJub.KOp
+	ksBaby, ksBabyStorage, err := loadKeyStoreBabyJub(&cfg.KeyStoreBaby, kOp)
+	if err != nil {
+		return nil, err
+	}
+	web3Pool, err := NewWeb3Pool(&cfg.Web3)
+	if err != nil {
+		return nil, err
+	}
+	gasPolicy := NewGasPolicy(&cfg.Gas)
+	ethClient, err := LoadEthClient(ks, acc, web3Pool)
+	if err != nil {
+		return nil, err
+	}
+	chainId, err := web3Pool.CheckChainId(cfg.Web3.ChainId)
+	if err != nil {
+		return nil, err
+	}
+	if err := CheckContract(ethClient, "IdenStates", &cfg.Contracts.IdenStates); err != nil {
+		return nil, err
+	}
 
-	zkFilesIdenState := cfg.IdenStateZKProof.Files.Value()
-	if err := zkFilesIdenState.LoadAll(); err != nil {
+	storage, err := LoadStorage(&cfg.Storage)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			storage.Close()
+		}
+	}()
+	if err := CheckSchemaVersion(storage); err != nil {
+		return nil, err
+	}
+	cfgIdens, err := LoadAllHostedIdentities(cfg, storage)
+	if err != nil {
 		return nil, err
 	}
+	for _, cfgIden := range cfgIdens[1:] {
+		if err := unlockKeyBabyJub(ksBaby, &cfg.KeyStoreBaby, &cfgIden.Keys.BabyJub.KOp); err != nil {
+			return nil, err
+		}
+	}
+	var idenPubOnChainer idenpubonchain.IdenPubOnChainer = idenpubonchain.New(ethClient,
+		idenpubonchain.ContractAddresses{
+			IdenStates: cfg.Contracts.IdenStates.Address,
+		})
+	if gasPolicy != nil {
+		idenPubOnChainer = &gasIdenPubOnChain{
+			IdenPubOnChainer: idenPubOnChainer,
+			client:           ethClient,
+			ks:               ks,
+			idenStates:       cfg.Contracts.IdenStates.Address,
+			gasPolicy:        gasPolicy,
+		}
+	}
+	idenPubOnChain := &serialIdenPubOnChain{IdenPubOnChainer: idenPubOnChainer}
 
-	is, err := LoadIssuer(&cfg.Identity.Id, storage, ksBaby, idenPubOnChain,
-		&issuer.IdenStateZkProofConf{Levels: cfg.IdenStateZKProof.Levels, Files: *zkFilesIdenState},
-		idenPubOffChainWriteHttp)
+	zkFilesIdenState, err := LoadZkFiles(&cfg.IdenStateZKProof.Files)
 	if err != nil {
 		return nil, err
 	}
@@ -247,19 +552,36 @@ func LoadServer(cfg *config.Config) (*Server, error) {
 	// proofClaims := LoadGenesis(mt, &cfg.Id, &cfg.Keys.BabyJub.KOp, &cfg.Keys.Ethereum)
 	// kUpdateMtp := proofClaims.KUpdateRoot.Proof.Mtp0.Bytes()
 
-	return &Server{
-		Cfg:                      cfg,
-		stopchPublish:            make(chan (interface{})),
-		stoppedchPublish:         make(chan (interface{})),
-		stopchSync:               make(chan (interface{})),
-		stoppedchSync:            make(chan (interface{})),
-		Issuer:                   is,
-		IdenPubOnChain:           idenPubOnChain,
-		IdenPubOffChainWriteHttp: idenPubOffChainWriteHttp,
+	srv := &Server{
+		Cfg:            cfg,
+		stopch:         make(chan (interface{})),
+		ks:             ks,
+		chainId:        chainId,
+		gasPolicy:      gasPolicy,
+		zkFiles:        zkFilesIdenState,
+		identities:     make(map[core.ID]*Identity),
+		Storage:        storage,
+		IdenPubOnChain: idenPubOnChain,
 		// KeyStore:       ks,
-		KeyStore:     nil,
-		KeyStoreBaby: ksBaby,
-		EthClient:    ethClient,
-		KOp:          kOp,
-	}, nil
+		KeyStore:            nil,
+		KeyStoreBaby:        ksBaby,
+		keyStoreBabyStorage: ksBabyStorage,
+		EthClient:           ethClient,
+		Web3Pool:            web3Pool,
+		KOp:                 kOp,
+	}
+	srv.Prover = NewProver(storage, cfg.IdenStateZKProof.Workers,
+		cfg.IdenStateZKProof.Timeout.Duration, srv.runPublishState)
+	for i := range cfgIdens {
+		iden, err := srv.LoadIdentity(&cfgIdens[i])
+		if err != nil {
+			return nil, err
+		}
+		srv.addIdentity(iden)
+	}
+	mainIden := srv.idens[0]
+	srv.Issuer = mainIden.Issuer
+	srv.IdenPubOffChainWriteHttp = mainIden.IdenPubOffChainWriteHttp
+	srv.TxWatchdog = mainIden.TxWatchdog
+	return srv, nil
 }
@@ -0,0 +1,41 @@
+package loaders
+
+import (
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckContract(t *testing.T) {
+	backend, server := newSimBackend(t, 100)
+	defer server.Close()
+	client, _, _, remove := newTestEthClient(t, server.URL)
+	defer remove()
+
+	code := []byte{0x60, 0x80, 0x60, 0x40}
+	contract := &config.Contract{Address: common.HexToAddress("0x0a")}
+
+	// No code at the address
+	err := CheckContract(client, "IdenStates", contract)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "No IdenStates contract bytecode found")
+
+	// Code without CodeHash
+	backend.mutex.Lock()
+	backend.code[contract.Address] = code
+	backend.mutex.Unlock()
+	require.Nil(t, CheckContract(client, "IdenStates", contract))
+
+	// Code with the expected CodeHash
+	contract.CodeHash = crypto.Keccak256Hash(code)
+	require.Nil(t, CheckContract(client, "IdenStates", contract))
+
+	// Code hash mismatch
+	contract.CodeHash = crypto.Keccak256Hash([]byte{0x00})
+	err = CheckContract(client, "IdenStates", contract)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "but "+contract.CodeHash.Hex()+" was expected")
+}
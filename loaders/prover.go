@@ -0,0 +1,322 @@
+package loaders
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-servers/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrProofTimeout is returned when a proof job doesn't finish before its
+	// timeout.
+	ErrProofTimeout = errors.New("Proof job timed out")
+	// ErrProofCancelled is returned when a proof job is cancelled.
+	ErrProofCancelled = errors.New("Proof job cancelled")
+	// ErrProverStopped is returned when the Prover is stopped.
+	ErrProverStopped = errors.New("Prover stopped")
+)
+
+var (
+	dbKeyProverQueue    = []byte("proverqueue")
+	metricProofDuration = metrics.NewTimer("issuer/prover/duration")
+	metricProofQueued   = metrics.NewGauge("issuer/prover/queued")
+	metricProofFailed   = metrics.NewCounter("issuer/prover/failed")
+	metricProofTimeout  = metrics.NewCounter("issuer/prover/timeout")
+)
+
+// ProofFunc runs the proof job of the identity id.  ctx is done when the job
+// times out or is cancelled.
+type ProofFunc func(ctx context.Context, id *core.ID) error
+
+type proofJob struct {
+	id     core.ID
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+	queued bool
+}
+
+// Prover runs the proof jobs of the identities in a bounded pool of
+// workers.  There's at most one job per identity: enqueuing the job of an
+// identity that is queued or running joins it.  The queue is stored so that
+// the jobs not finished when the Prover stops are resumed on Start.
+//
+// The timeout of a job starts when a worker runs it.  A job that times out
+// or is cancelled while running is finished right away, but it can only be
+// stopped by its ProofFunc, so its worker is busy until the ProofFunc
+// returns.  Meanwhile a new job of its identity is queued but not run, so
+// that a ProofFunc that doesn't return can only keep one worker busy.
+type Prover struct {
+	mutex   sync.Mutex
+	cond    *sync.Cond
+	storage db.Storage
+	run     ProofFunc
+	workers int
+	timeout time.Duration
+	queue   []*proofJob
+	jobs    map[core.ID]*proofJob
+	// running has the identities whose ProofFunc is running, even if their
+	// job has been finished
+	running map[core.ID]bool
+	started bool
+	stopped sync.WaitGroup
+}
+
+// NewProver creates a Prover that runs the jobs with run in workers
+// goroutines and stores its queue in storage.  A timeout of 0 means no
+// timeout.
+func NewProver(storage db.Storage, workers int, timeout time.Duration, run ProofFunc) *Prover {
+	if workers <= 0 {
+		workers = 1
+	}
+	p := &Prover{
+		storage: storage,
+		run:     run,
+		workers: workers,
+		timeout: timeout,
+		jobs:    make(map[core.ID]*proofJob),
+		running: make(map[core.ID]bool),
+	}
+	p.cond = sync.NewCond(&p.mutex)
+	return p
+}
+
+// Start starts the workers and enqueues the jobs stored by a previous run.
+func (p *Prover) Start() error {
+	var ids []core.ID
+	if err := db.LoadJSON(p.storage, dbKeyProverQueue, &ids); err != nil && err != db.ErrNotFound {
+		return fmt.Errorf("Error loading prover queue: %w", err)
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.started = true
+	for i := range ids {
+		log.WithField("id", &ids[i]).Info("Resuming proof job")
+		p.enqueue(&ids[i])
+	}
+	for i := 0; i < p.workers; i++ {
+		p.stopped.Add(1)
+		go p.worker()
+	}
+	return p.store()
+}
+
+// StopAndJoin cancels the jobs and waits for the running ones to return.
+// The unfinished jobs are kept in the storage and fail with
+// ErrProverStopped.
+func (p *Prover) StopAndJoin() {
+	p.mutex.Lock()
+	p.started = false
+	for _, job := range p.jobs {
+		job.cancel()
+	}
+	p.cond.Broadcast()
+	p.mutex.Unlock()
+	p.stopped.Wait()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.store(); err != nil {
+		log.WithField("err", err).Error("Prover: storing queue")
+	}
+	for _, job := range p.jobs {
+		job.err = ErrProverStopped
+		close(job.done)
+	}
+	p.jobs = make(map[core.ID]*proofJob)
+	p.queue = nil
+}
+
+// store writes the ids of the unfinished jobs to the storage, the queued
+// ones first.  Must be called with the mutex locked.
+func (p *Prover) store() error {
+	ids := make([]core.ID, 0, len(p.jobs))
+	for _, job := range p.queue {
+		ids = append(ids, job.id)
+	}
+	for _, job := range p.jobs {
+		if !job.queued {
+			ids = append(ids, job.id)
+		}
+	}
+	metricProofQueued.Update(int64(len(p.queue)))
+	tx, err := p.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	if err := db.StoreJSON(tx, dbKeyProverQueue, ids); err != nil {
+		tx.Close()
+		return err
+	}
+	return tx.Commit()
+}
+
+// enqueue returns the job of the identity id, adding it to the queue if
+// it's not queued or running.  Must be called with the mutex locked.
+func (p *Prover) enqueue(id *core.ID) *proofJob {
+	if job, ok := p.jobs[*id]; ok {
+		return job
+	}
+	job := &proofJob{id: *id, done: make(chan struct{}), queued: true}
+	job.ctx, job.cancel = context.WithCancel(context.Background())
+	p.jobs[*id] = job
+	p.queue = append(p.queue, job)
+	p.cond.Signal()
+	return job
+}
+
+// finish removes the job and sets its result.  Must be called with the
+// mutex locked.
+func (p *Prover) finish(job *proofJob, err error) {
+	delete(p.jobs, job.id)
+	if job.queued {
+		for i, queued := range p.queue {
+			if queued == job {
+				p.queue = append(p.queue[:i], p.queue[i+1:]...)
+				break
+			}
+		}
+		job.queued = false
+	}
+	job.cancel()
+	job.err = err
+	close(job.done)
+	if err == ErrProofTimeout {
+		metricProofTimeout.Inc(1)
+	}
+	if err := p.store(); err != nil {
+		log.WithField("err", err).Error("Prover: storing queue")
+	}
+}
+
+// finished returns true if the job has been finished.  Must be called with
+// the mutex locked.
+func (p *Prover) finished(job *proofJob) bool {
+	return p.jobs[job.id] != job
+}
+
+// next removes from the queue and returns the first job whose identity
+// doesn't have a ProofFunc running, or nil if there's none.  Must be called
+// with the mutex locked.
+func (p *Prover) next() *proofJob {
+	for i, job := range p.queue {
+		if !p.running[job.id] {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			return job
+		}
+	}
+	return nil
+}
+
+// ctxErr returns the error of a job whose ctx is done.
+func ctxErr(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrProofTimeout
+	}
+	return ErrProofCancelled
+}
+
+func (p *Prover) worker() {
+	defer p.stopped.Done()
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for {
+		var job *proofJob
+		for p.started {
+			if job = p.next(); job != nil {
+				break
+			}
+			p.cond.Wait()
+		}
+		if !p.started {
+			return
+		}
+		job.queued = false
+		p.running[job.id] = true
+		metricProofQueued.Update(int64(len(p.queue)))
+		ctx, cancel := job.ctx, context.CancelFunc(func() {})
+		if p.timeout != 0 {
+			ctx, cancel = context.WithTimeout(job.ctx, p.timeout)
+		}
+		p.mutex.Unlock()
+
+		// Finish the job as soon as it times out or is cancelled
+		returned := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				p.mutex.Lock()
+				if p.started && !p.finished(job) {
+					p.finish(job, ctxErr(ctx))
+				}
+				p.mutex.Unlock()
+			case <-returned:
+			}
+		}()
+		start := time.Now()
+		err := p.run(ctx, &job.id)
+		close(returned)
+		metricProofDuration.UpdateSince(start)
+		logger := log.WithField("id", &job.id).WithField("elapsed", time.Since(start))
+		if err != nil && ctx.Err() != nil {
+			err = ctxErr(ctx)
+		}
+		cancel()
+		switch {
+		case err == ErrProofTimeout:
+			logger.Warn("Proof job timed out")
+		case err != nil:
+			metricProofFailed.Inc(1)
+			logger.WithField("err", err).Debug("Proof job failed")
+		default:
+			logger.Debug("Proof job finished")
+		}
+
+		p.mutex.Lock()
+		delete(p.running, job.id)
+		// A queued job of the identity can run now
+		p.cond.Broadcast()
+		// A job stopped with the Prover is kept to resume it on Start
+		if !p.finished(job) && (p.started || err == nil) {
+			p.finish(job, err)
+		}
+	}
+}
+
+// Prove enqueues the job of the identity id, or joins the queued or running
+// one, and waits for its result.
+func (p *Prover) Prove(id *core.ID) error {
+	p.mutex.Lock()
+	if !p.started {
+		p.mutex.Unlock()
+		return ErrProverStopped
+	}
+	job := p.enqueue(id)
+	if err := p.store(); err != nil {
+		log.WithField("err", err).Error("Prover: storing queue")
+	}
+	p.mutex.Unlock()
+	<-job.done
+	return job.err
+}
+
+// Cancel cancels the queued or running job of the identity id, and returns
+// false if there's none.
+func (p *Prover) Cancel(id *core.ID) bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	job, ok := p.jobs[*id]
+	if !ok || !p.started {
+		return false
+	}
+	p.finish(job, ErrProofCancelled)
+	return true
+}
@@ -0,0 +1,254 @@
+package loaders
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/stretchr/testify/require"
+)
+
+func proverTestId(b byte) *core.ID {
+	id := core.NewID(core.TypeBJP0, [27]byte{b})
+	return &id
+}
+
+func TestProverWorkers(t *testing.T) {
+	var mutex sync.Mutex
+	running, maxRunning, runs := 0, 0, 0
+	p := NewProver(db.NewMemoryStorage(), 2, 0, func(ctx context.Context, id *core.ID) error {
+		mutex.Lock()
+		running++
+		runs++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		return nil
+	})
+	require.Nil(t, p.Start())
+	defer p.StopAndJoin()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			require.Nil(t, p.Prove(proverTestId(byte(i%3))))
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, 2, maxRunning)
+	// The jobs of the same identity are joined
+	require.LessOrEqual(t, runs, 6)
+	require.GreaterOrEqual(t, runs, 3)
+}
+
+func TestProverTimeoutCancel(t *testing.T) {
+	release := make(chan struct{})
+	p := NewProver(db.NewMemoryStorage(), 1, 100*time.Millisecond, func(ctx context.Context, id *core.ID) error {
+		<-release
+		return ctx.Err()
+	})
+	require.Nil(t, p.Start())
+	defer p.StopAndJoin()
+
+	// Running job timed out
+	require.Equal(t, ErrProofTimeout, p.Prove(proverTestId(1)))
+
+	// Queued job cancelled while the only worker is busy
+	errs := make(chan error)
+	go func() { errs <- p.Prove(proverTestId(2)) }()
+	for !p.Cancel(proverTestId(2)) {
+		time.Sleep(time.Millisecond)
+	}
+	require.Equal(t, ErrProofCancelled, <-errs)
+	require.False(t, p.Cancel(proverTestId(2)))
+	close(release)
+}
+
+func TestProverResume(t *testing.T) {
+	storage := db.NewMemoryStorage()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	p := NewProver(storage, 1, 0, func(ctx context.Context, id *core.ID) error {
+		started <- struct{}{}
+		<-release
+		return ctx.Err()
+	})
+	require.Nil(t, p.Start())
+	errs := make(chan error, 2)
+	go func() { errs <- p.Prove(proverTestId(1)) }()
+	<-started
+	go func() { errs <- p.Prove(proverTestId(2)) }()
+	for {
+		p.mutex.Lock()
+		n := len(p.queue)
+		p.mutex.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	p.StopAndJoin()
+	require.Equal(t, ErrProverStopped, <-errs)
+	require.Equal(t, ErrProverStopped, <-errs)
+
+	// The running and queued jobs are resumed
+	var resumed []core.ID
+	var mutex sync.Mutex
+	done := make(chan struct{}, 2)
+	p = NewProver(storage, 1, 0, func(ctx context.Context, id *core.ID) error {
+		mutex.Lock()
+		resumed = append(resumed, *id)
+		mutex.Unlock()
+		done <- struct{}{}
+		return nil
+	})
+	require.Nil(t, p.Start())
+	<-done
+	<-done
+	p.StopAndJoin()
+	require.ElementsMatch(t, []core.ID{*proverTestId(1), *proverTestId(2)}, resumed)
+
+	var ids []core.ID
+	require.Nil(t, db.LoadJSON(storage, dbKeyProverQueue, &ids))
+	require.Equal(t, 0, len(ids))
+}
+
+func TestProverTimeoutRetry(t *testing.T) {
+	var mutex sync.Mutex
+	runs := make(map[core.ID]int)
+	release := make(chan struct{})
+	p := NewProver(db.NewMemoryStorage(), 2, 100*time.Millisecond, func(ctx context.Context, id *core.ID) error {
+		mutex.Lock()
+		runs[*id]++
+		mutex.Unlock()
+		// The jobs of the identity 1 ignore ctx and block, like a state
+		// transition waiting for a hung one of the same identity
+		if *id == *proverTestId(1) {
+			<-release
+		}
+		return nil
+	})
+	require.Nil(t, p.Start())
+	defer p.StopAndJoin()
+	var releaseOnce sync.Once
+	releaseAll := func() { releaseOnce.Do(func() { close(release) }) }
+	defer releaseAll()
+	runsOf := func(id *core.ID) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return runs[*id]
+	}
+
+	require.Equal(t, ErrProofTimeout, p.Prove(proverTestId(1)))
+	// The new job of the identity waits for the ProofFunc of the timed out
+	// one to return, without taking the other worker
+	errs := make(chan error)
+	go func() { errs <- p.Prove(proverTestId(1)) }()
+	require.Eventually(t, func() bool {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		return len(p.queue) == 1
+	}, time.Second, time.Millisecond)
+	for i := byte(2); i < 5; i++ {
+		served := make(chan error, 1)
+		go func() { served <- p.Prove(proverTestId(i)) }()
+		select {
+		case err := <-served:
+			require.Nil(t, err)
+		case <-time.After(time.Second):
+			t.Fatalf("Identity %v not served", i)
+		}
+		require.Equal(t, 1, runsOf(proverTestId(i)))
+	}
+	require.Equal(t, 1, runsOf(proverTestId(1)))
+
+	releaseAll()
+	require.Nil(t, <-errs)
+	require.Equal(t, 2, runsOf(proverTestId(1)))
+}
+
+func TestProverTimeoutStartsRunning(t *testing.T) {
+	p := NewProver(db.NewMemoryStorage(), 1, 150*time.Millisecond, func(ctx context.Context, id *core.ID) error {
+		select {
+		case <-time.After(100 * time.Millisecond):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	require.Nil(t, p.Start())
+	defer p.StopAndJoin()
+
+	// The second job waits 100ms in the queue, which doesn't count against
+	// its timeout
+	errs := make(chan error, 2)
+	go func() { errs <- p.Prove(proverTestId(1)) }()
+	go func() { errs <- p.Prove(proverTestId(2)) }()
+	require.Nil(t, <-errs)
+	require.Nil(t, <-errs)
+}
+
+func TestProverStopStart(t *testing.T) {
+	storage := db.NewMemoryStorage()
+	started := make(chan struct{}, 1)
+	var mutex sync.Mutex
+	var ran []core.ID
+	p := NewProver(storage, 1, 0, func(ctx context.Context, id *core.ID) error {
+		mutex.Lock()
+		ran = append(ran, *id)
+		mutex.Unlock()
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	require.Nil(t, p.Start())
+	errs := make(chan error, 2)
+	go func() { errs <- p.Prove(proverTestId(1)) }()
+	<-started
+	go func() { errs <- p.Prove(proverTestId(2)) }()
+	for {
+		p.mutex.Lock()
+		n := len(p.queue)
+		p.mutex.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	p.StopAndJoin()
+	require.Equal(t, ErrProverStopped, <-errs)
+	require.Equal(t, ErrProverStopped, <-errs)
+	require.Equal(t, 0, len(p.queue))
+	require.Equal(t, 0, len(p.jobs))
+	require.Equal(t, ErrProverStopped, p.Prove(proverTestId(3)))
+
+	// Start again runs new jobs for the stored ones instead of the
+	// cancelled jobs
+	require.Nil(t, p.Start())
+	<-started
+	require.True(t, p.Cancel(proverTestId(2)))
+	<-started
+	require.True(t, p.Cancel(proverTestId(1)))
+	p.StopAndJoin()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Equal(t, []core.ID{*proverTestId(1), *proverTestId(2), *proverTestId(1)}, ran)
+	var ids []core.ID
+	require.Nil(t, db.LoadJSON(storage, dbKeyProverQueue, &ids))
+	require.Equal(t, 0, len(ids))
+}
@@ -0,0 +1,156 @@
+package loaders
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/iden3/go-iden3-core/db"
+	log "github.com/sirupsen/logrus"
+)
+
+// SchemaVersion is the version of the storage layout written by this server.
+const SchemaVersion = 1
+
+// SchemaVersionKey is the reserved storage key that holds the schema version
+// of the storage as a little endian uint32.
+var SchemaVersionKey = []byte("schemaversion")
+
+// Migration upgrades the storage layout from schema version Version-1 to
+// Version.  Migrate writes its changes in tx, which is committed together
+// with the new schema version.  Migrate must be idempotent.
+type Migration struct {
+	Version     int
+	Description string
+	Migrate     func(storage db.Storage, tx db.Tx) error
+}
+
+var migrations []Migration
+
+// RegisterMigration registers the migration to the next schema version.
+func RegisterMigration(m Migration) {
+	if m.Version != len(migrations)+1 {
+		panic(fmt.Sprintf("migration to schema version %v registered out of order", m.Version))
+	}
+	migrations = append(migrations, m)
+}
+
+func init() {
+	// Storages written before the schema version was recorded have the
+	// layout of version 1.
+	RegisterMigration(Migration{
+		Version:     1,
+		Description: "record the schema version",
+		Migrate:     func(db.Storage, db.Tx) error { return nil },
+	})
+	if len(migrations) != SchemaVersion {
+		panic(fmt.Sprintf("missing migrations to schema version %v", SchemaVersion))
+	}
+}
+
+// LoadSchemaVersion returns the schema version of storage.  Storages without
+// the schema version key have version 0.
+func LoadSchemaVersion(storage db.Storage) (int, error) {
+	v, err := storage.Get(SchemaVersionKey)
+	if errors.Is(err, db.ErrNotFound) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if len(v) != 4 {
+		return 0, fmt.Errorf("Unknown storage schema version 0x%v", hex.EncodeToString(v))
+	}
+	return int(binary.LittleEndian.Uint32(v)), nil
+}
+
+func putSchemaVersion(tx db.Tx, version int) {
+	var v [4]byte
+	binary.LittleEndian.PutUint32(v[:], uint32(version))
+	tx.Put(SchemaVersionKey, v[:])
+}
+
+// CheckSchemaVersion returns an error if the schema version of storage is not
+// SchemaVersion.
+func CheckSchemaVersion(storage db.Storage) error {
+	version, err := LoadSchemaVersion(storage)
+	if err != nil {
+		return err
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("Storage schema version %v is newer than the supported %v, upgrade the server",
+			version, SchemaVersion)
+	} else if version < SchemaVersion {
+		return fmt.Errorf("Storage schema version %v is older than %v, run db migrate or start with --migrate",
+			version, SchemaVersion)
+	}
+	return nil
+}
+
+// PendingMigrations returns the schema version of storage and the
+// migrations needed to upgrade it to SchemaVersion.
+func PendingMigrations(storage db.Storage) (int, []Migration, error) {
+	version, err := LoadSchemaVersion(storage)
+	if err != nil {
+		return 0, nil, err
+	}
+	if version > SchemaVersion {
+		return 0, nil, fmt.Errorf("Storage schema version %v is newer than the supported %v",
+			version, SchemaVersion)
+	}
+	return version, migrations[version:], nil
+}
+
+// Migrate runs the pending migrations of storage.  Each migration is
+// committed in a transaction with its schema version, so an interrupted
+// migration is resumed from the last version committed.
+func Migrate(storage db.Storage) error {
+	_, pending, err := PendingMigrations(storage)
+	if err != nil {
+		return err
+	}
+	for _, m := range pending {
+		tx, err := storage.NewTx()
+		if err != nil {
+			return err
+		}
+		if err := m.Migrate(storage, tx); err != nil {
+			tx.Close()
+			return fmt.Errorf("Error migrating storage to schema version %v: %w", m.Version, err)
+		}
+		putSchemaVersion(tx, m.Version)
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.WithField("version", m.Version).WithField("migration", m.Description).Info("Storage migrated")
+	}
+	return nil
+}
+
+// InitSchemaVersion records SchemaVersion in storage if it's empty.
+func InitSchemaVersion(storage db.Storage) error {
+	tx, err := storage.NewTx()
+	if err != nil {
+		return err
+	}
+	if err := initSchemaVersion(storage, tx); err != nil {
+		tx.Close()
+		return err
+	}
+	return tx.Commit()
+}
+
+// initSchemaVersion records SchemaVersion in tx if storage is empty.
+func initSchemaVersion(storage db.Storage, tx db.Tx) error {
+	empty := true
+	if err := storage.Iterate(func(k, v []byte) (bool, error) {
+		empty = false
+		return false, nil
+	}); err != nil {
+		return err
+	}
+	if empty {
+		putSchemaVersion(tx, SchemaVersion)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package loaders
+
+import (
+	"testing"
+
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSchemaVersion(t *testing.T) {
+	storage := db.NewMemoryStorage()
+	require.Nil(t, InitSchemaVersion(storage))
+	require.Nil(t, CheckSchemaVersion(storage))
+
+	// Storage written before the schema version was recorded
+	storage = db.NewMemoryStorage()
+	tx, err := storage.NewTx()
+	require.Nil(t, err)
+	tx.Put([]byte("k"), []byte("v"))
+	require.Nil(t, tx.Commit())
+	require.Nil(t, InitSchemaVersion(storage))
+	require.Error(t, CheckSchemaVersion(storage))
+	version, pending, err := PendingMigrations(storage)
+	require.Nil(t, err)
+	require.Equal(t, 0, version)
+	require.Equal(t, SchemaVersion, len(pending))
+	require.Nil(t, Migrate(storage))
+	require.Nil(t, CheckSchemaVersion(storage))
+	require.Nil(t, Migrate(storage))
+	_, pending, err = PendingMigrations(storage)
+	require.Nil(t, err)
+	require.Empty(t, pending)
+
+	// Storage written by a newer server
+	tx, err = storage.NewTx()
+	require.Nil(t, err)
+	putSchemaVersion(tx, SchemaVersion+1)
+	require.Nil(t, tx.Commit())
+	require.Error(t, CheckSchemaVersion(storage))
+	require.Error(t, Migrate(storage))
+}
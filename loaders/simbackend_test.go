@@ -0,0 +1,134 @@
+package loaders
+
+import (
+	"errors"
+	"math/big"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/stretchr/testify/require"
+)
+
+// simBackend is a local web3 backend of a chain with a single account.  Its
+// blocks are empty unless a sent transaction is mined with mine, so that the
+// tests control when transactions get stuck.
+type simBackend struct {
+	height   uint64
+	calls    int64
+	mutex    sync.Mutex
+	gasPrice *big.Int
+	chainId  *big.Int
+	code     map[common.Address][]byte
+	sent     map[common.Hash]*types.Transaction
+	// mined has the block number of the mined transactions, and minedNonces
+	// their nonces
+	mined       map[common.Hash]uint64
+	minedNonces map[uint64]bool
+}
+
+func (b *simBackend) GasPrice() *hexutil.Big {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return (*hexutil.Big)(b.gasPrice)
+}
+
+func (b *simBackend) BlockNumber() hexutil.Uint64 {
+	atomic.AddInt64(&b.calls, 1)
+	return hexutil.Uint64(atomic.LoadUint64(&b.height))
+}
+
+func (b *simBackend) ChainId() *hexutil.Big {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return (*hexutil.Big)(b.chainId)
+}
+
+func (b *simBackend) GetCode(address common.Address, block rpc.BlockNumber) hexutil.Bytes {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.code[address]
+}
+
+func (b *simBackend) GetBlockByNumber(number rpc.BlockNumber, full bool) *types.Header {
+	height := atomic.LoadUint64(&b.height)
+	if number >= 0 {
+		height = uint64(number)
+	}
+	return &types.Header{Number: new(big.Int).SetUint64(height), Difficulty: big.NewInt(0)}
+}
+
+// SendRawTransaction adds the transaction to the pool.  Like geth, it fails
+// with "already known" if it was already sent, and with "nonce too low" if
+// a transaction with its nonce was mined.
+func (b *simBackend) SendRawTransaction(data hexutil.Bytes) (common.Hash, error) {
+	var tx types.Transaction
+	if err := rlp.DecodeBytes(data, &tx); err != nil {
+		return common.Hash{}, err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if _, ok := b.sent[tx.Hash()]; ok {
+		return common.Hash{}, errors.New("already known")
+	}
+	if b.minedNonces[tx.Nonce()] {
+		return common.Hash{}, errors.New("nonce too low")
+	}
+	b.sent[tx.Hash()] = &tx
+	return tx.Hash(), nil
+}
+
+func (b *simBackend) GetTransactionReceipt(hash common.Hash) *types.Receipt {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	block, ok := b.mined[hash]
+	if !ok {
+		return nil
+	}
+	return &types.Receipt{Status: types.ReceiptStatusSuccessful, Logs: []*types.Log{},
+		TxHash: hash, BlockNumber: new(big.Int).SetUint64(block)}
+}
+
+// advance adds n empty blocks.
+func (b *simBackend) advance(n uint64) {
+	atomic.AddUint64(&b.height, n)
+}
+
+// mine adds a block with the sent transaction tx.
+func (b *simBackend) mine(t *testing.T, tx *types.Transaction) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	_, ok := b.sent[tx.Hash()]
+	require.True(t, ok)
+	require.False(t, b.minedNonces[tx.Nonce()])
+	b.mined[tx.Hash()] = atomic.AddUint64(&b.height, 1)
+	b.minedNonces[tx.Nonce()] = true
+}
+
+// sentTxs returns the number of transactions sent.
+func (b *simBackend) sentTxs() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return len(b.sent)
+}
+
+func newSimBackend(t *testing.T, height uint64) (*simBackend, *httptest.Server) {
+	backend := &simBackend{
+		height:      height,
+		gasPrice:    big.NewInt(10000000000),
+		chainId:     big.NewInt(1337),
+		code:        make(map[common.Address][]byte),
+		sent:        make(map[common.Hash]*types.Transaction),
+		mined:       make(map[common.Hash]uint64),
+		minedNonces: make(map[uint64]bool),
+	}
+	server := rpc.NewServer()
+	require.Nil(t, server.RegisterName("eth", backend))
+	return backend, httptest.NewServer(server)
+}
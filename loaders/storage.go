@@ -0,0 +1,101 @@
+package loaders
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/iden3/go-iden3-servers/storage"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+const (
+	StorageTypeLevelDb = "leveldb"
+	StorageTypeBolt    = "bolt"
+	StorageTypeMemory  = "memory"
+)
+
+// StorageBackend opens a storage with the storage configuration.
+type StorageBackend func(cfg *config.Storage) (db.Storage, error)
+
+var storageBackends = map[string]StorageBackend{}
+
+// RegisterStorageBackend makes a storage backend available with the given
+// Storage.Type.
+func RegisterStorageBackend(storageType string, backend StorageBackend) {
+	if _, ok := storageBackends[storageType]; ok {
+		panic(fmt.Sprintf("storage backend %v registered twice", storageType))
+	}
+	storageBackends[storageType] = backend
+}
+
+// StorageTypes returns the registered storage types.
+func StorageTypes() []string {
+	types := make([]string, 0, len(storageBackends))
+	for storageType := range storageBackends {
+		types = append(types, storageType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+func init() {
+	RegisterStorageBackend(StorageTypeLevelDb, func(cfg *config.Storage) (db.Storage, error) {
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("Storage.Path is required")
+		}
+		return storage.NewLevelDbStorage(cfg.Path, &opt.Options{
+			ErrorIfMissing:         cfg.ReadOnly,
+			ReadOnly:               cfg.ReadOnly,
+			BlockCacheCapacity:     cfg.LevelDb.BlockCacheCapacity,
+			WriteBuffer:            cfg.LevelDb.WriteBuffer,
+			OpenFilesCacheCapacity: cfg.LevelDb.OpenFilesCacheCapacity,
+			CompactionTableSize:    cfg.LevelDb.CompactionTableSize,
+			CompactionTotalSize:    cfg.LevelDb.CompactionTotalSize,
+			CompactionL0Trigger:    cfg.LevelDb.CompactionL0Trigger,
+			DisableSeeksCompaction: cfg.LevelDb.DisableSeeksCompaction,
+		})
+	})
+	RegisterStorageBackend(StorageTypeBolt, func(cfg *config.Storage) (db.Storage, error) {
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("Storage.Path is required")
+		}
+		return storage.NewBoltStorage(cfg.Path, cfg.ReadOnly)
+	})
+	RegisterStorageBackend(StorageTypeMemory, func(cfg *config.Storage) (db.Storage, error) {
+		return db.NewMemoryStorage(), nil
+	})
+}
+
+// LoadStorage opens the storage with the backend selected by the Storage.Type,
+// which is leveldb by default.
+func LoadStorage(cfg *config.Storage) (db.Storage, error) {
+	storageType := cfg.Type
+	if storageType == "" {
+		storageType = StorageTypeLevelDb
+	}
+	backend, ok := storageBackends[storageType]
+	if !ok {
+		return nil, fmt.Errorf("Unknown storage type %q, available types: %v",
+			storageType, StorageTypes())
+	}
+	sto, err := backend(cfg)
+	if err == storage.ErrLocked {
+		return nil, fmt.Errorf("Error opening %v storage at %v: %w (stop it or use the admin API)",
+			storageType, cfg.Path, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("Error opening %v storage: %w", storageType, err)
+	}
+	log.WithField("type", storageType).WithField("path", cfg.Path).
+		WithField("readOnly", cfg.ReadOnly).Info("Storage opened")
+	return sto, nil
+}
+
+// LoadStorageReadOnly opens the storage in read-only mode.
+func LoadStorageReadOnly(cfg *config.Storage) (db.Storage, error) {
+	cfgReadOnly := *cfg
+	cfgReadOnly.ReadOnly = true
+	return LoadStorage(&cfgReadOnly)
+}
@@ -0,0 +1,254 @@
+package loaders
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	ethkeystore "github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	zktypes "github.com/iden3/go-circom-prover-verifier/types"
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/eth"
+	"github.com/iden3/go-iden3-core/merkletree"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/iden3/go-iden3-servers/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// txBumpPercentDefault is the BumpPercent used when it's not configured.
+	txBumpPercentDefault = 12
+	// txBumpPercentMin is the minimum gas price increase accepted by the
+	// nodes to replace a pending transaction.
+	txBumpPercentMin = 10
+)
+
+var (
+	dbKeyTxWatchdogPending = []byte("pending")
+	metricTxReplaced       = metrics.NewCounter("issuer/publishstate/replaced")
+)
+
+// pendingTx is a state transition transaction with all its replacements,
+// from the original to the last one, and the block number at which the last
+// one was sent.
+type pendingTx struct {
+	Txs       []*types.Transaction
+	SentBlock uint64
+}
+
+// TxWatchdog is an IdenPubOnChainer that keeps track of the state transition
+// transactions and replaces them with a higher gas price when they are not
+// mined after StuckBlocks blocks.  The replacements are transparent to the
+// issuer, which only knows about the original transaction.
+type TxWatchdog struct {
+	idenpubonchain.IdenPubOnChainer
+	mutex       sync.Mutex
+	client      *eth.Client
+	ks          *ethkeystore.KeyStore
+	account     *accounts.Account
+	chainId     *big.Int
+	gasPolicy   *GasPolicy
+	storage     db.Storage
+	stuckBlocks uint64
+	bumpPercent uint64
+}
+
+// NewTxWatchdog creates a TxWatchdog around idenPubOnChain that stores the
+// pending transaction in storage.
+func NewTxWatchdog(idenPubOnChain idenpubonchain.IdenPubOnChainer, client *eth.Client,
+	ks *ethkeystore.KeyStore, chainId uint64, cfg *config.Gas, gasPolicy *GasPolicy,
+	storage db.Storage) (*TxWatchdog, error) {
+	bumpPercent := cfg.BumpPercent
+	if bumpPercent == 0 {
+		bumpPercent = txBumpPercentDefault
+	} else if bumpPercent < txBumpPercentMin {
+		return nil, fmt.Errorf("Gas.BumpPercent must be at least %v", txBumpPercentMin)
+	}
+	return &TxWatchdog{
+		IdenPubOnChainer: idenPubOnChain,
+		client:           client,
+		ks:               ks,
+		account:          client.Account(),
+		chainId:          new(big.Int).SetUint64(chainId),
+		gasPolicy:        gasPolicy,
+		storage:          storage,
+		stuckBlocks:      cfg.StuckBlocks,
+		bumpPercent:      bumpPercent,
+	}, nil
+}
+
+func (w *TxWatchdog) load() (*pendingTx, error) {
+	var pending pendingTx
+	if err := db.LoadJSON(w.storage, dbKeyTxWatchdogPending, &pending); err == db.ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(pending.Txs) == 0 {
+		return nil, nil
+	}
+	return &pending, nil
+}
+
+func (w *TxWatchdog) store(pending *pendingTx) error {
+	tx, err := w.storage.NewTx()
+	if err != nil {
+		return err
+	}
+	if err := db.StoreJSON(tx, dbKeyTxWatchdogPending, pending); err != nil {
+		tx.Close()
+		return err
+	}
+	return tx.Commit()
+}
+
+// track stores tx as the new pending transaction.
+func (w *TxWatchdog) track(tx *types.Transaction) error {
+	currentBlock, err := w.client.CurrentBlock()
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.store(&pendingTx{Txs: []*types.Transaction{tx}, SentBlock: currentBlock.Uint64()})
+}
+
+// InitState calls InitState of the wrapped IdenPubOnChainer and tracks the
+// transaction.
+func (w *TxWatchdog) InitState(id *core.ID, genesisState *merkletree.Hash,
+	newState *merkletree.Hash, proof *zktypes.Proof) (*types.Transaction, error) {
+	tx, err := w.IdenPubOnChainer.InitState(id, genesisState, newState, proof)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.track(tx); err != nil {
+		log.WithField("tx", tx.Hash().Hex()).WithField("err", err).Error("TxWatchdog: tracking transaction")
+	}
+	return tx, nil
+}
+
+// SetState calls SetState of the wrapped IdenPubOnChainer and tracks the
+// transaction.
+func (w *TxWatchdog) SetState(id *core.ID, newState *merkletree.Hash,
+	proof *zktypes.Proof) (*types.Transaction, error) {
+	tx, err := w.IdenPubOnChainer.SetState(id, newState, proof)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.track(tx); err != nil {
+		log.WithField("tx", tx.Hash().Hex()).WithField("err", err).Error("TxWatchdog: tracking transaction")
+	}
+	return tx, nil
+}
+
+// TxConfirmBlocks returns the number of confirmed blocks of transaction tx
+// or of the replacement that was mined.
+func (w *TxWatchdog) TxConfirmBlocks(tx *types.Transaction) (*big.Int, error) {
+	pending, err := w.load()
+	if err != nil {
+		return nil, err
+	}
+	if pending != nil && pending.Txs[0].Hash() == tx.Hash() {
+		return w.txsConfirmBlocks(pending.Txs)
+	}
+	return w.IdenPubOnChainer.TxConfirmBlocks(tx)
+}
+
+// txsConfirmBlocks returns the number of confirmed blocks of the first mined
+// transaction of txs.  Only one can be mined, as all have the same nonce.
+func (w *TxWatchdog) txsConfirmBlocks(txs []*types.Transaction) (*big.Int, error) {
+	for i := len(txs) - 1; i >= 0; i-- {
+		confirmBlocks, err := w.IdenPubOnChainer.TxConfirmBlocks(txs[i])
+		if err == eth.ErrReceiptNotReceived {
+			continue
+		}
+		return confirmBlocks, err
+	}
+	return nil, eth.ErrReceiptNotReceived
+}
+
+// Check replaces the pending transaction if it hasn't been mined after
+// StuckBlocks blocks since it was sent.  The replacement has the same nonce
+// and the gas price increased by BumpPercent, or the one given by the gas
+// policy if higher, capped at the policy MaxGasPrice.
+func (w *TxWatchdog) Check() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	pending, err := w.load()
+	if err != nil {
+		return err
+	}
+	if pending == nil {
+		return nil
+	}
+	if _, err := w.txsConfirmBlocks(pending.Txs); err != eth.ErrReceiptNotReceived {
+		return nil
+	}
+	currentBlock, err := w.client.CurrentBlock()
+	if err != nil {
+		return err
+	}
+	if currentBlock.Uint64() < pending.SentBlock+w.stuckBlocks {
+		return nil
+	}
+
+	last := pending.Txs[len(pending.Txs)-1]
+	gasPrice, err := w.replacementGasPrice(last.GasPrice())
+	if err != nil {
+		return fmt.Errorf("Stuck transaction %v can't be replaced: %w", last.Hash().Hex(), err)
+	}
+	tx, err := w.ks.SignTx(*w.account, types.NewTransaction(last.Nonce(), *last.To(),
+		last.Value(), last.Gas(), gasPrice, last.Data()), w.chainId)
+	if err != nil {
+		return fmt.Errorf("Error signing replacement transaction: %w", err)
+	}
+	if err := w.client.Call(func(c *ethclient.Client) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return c.SendTransaction(ctx, tx)
+	}); err != nil {
+		return fmt.Errorf("Error sending replacement transaction: %w", err)
+	}
+	metricTxReplaced.Inc(1)
+	log.WithField("tx", last.Hash().Hex()).WithField("replacement", tx.Hash().Hex()).
+		WithField("nonce", tx.Nonce()).WithField("gasPrice", gasPrice).
+		WithField("blocks", currentBlock.Uint64()-pending.SentBlock).
+		Warn("Stuck state transition transaction replaced")
+
+	pending.Txs = append(pending.Txs, tx)
+	pending.SentBlock = currentBlock.Uint64()
+	return w.store(pending)
+}
+
+// replacementGasPrice returns the gas price of the replacement of a
+// transaction with gas price last.
+func (w *TxWatchdog) replacementGasPrice(last *big.Int) (*big.Int, error) {
+	gasPrice := new(big.Int).Mul(last, new(big.Int).SetUint64(100+w.bumpPercent))
+	gasPrice.Div(gasPrice, big.NewInt(100))
+	var suggested *big.Int
+	if err := w.client.Call(func(c *ethclient.Client) (err error) {
+		suggested, err = suggestGasPrice(c, w.gasPolicy)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if suggested.Cmp(gasPrice) == 1 {
+		gasPrice = suggested
+	}
+	if w.gasPolicy != nil {
+		gasPrice = w.gasPolicy.Cap(gasPrice)
+	}
+	minGasPrice := new(big.Int).Mul(last, big.NewInt(100+txBumpPercentMin))
+	minGasPrice.Div(minGasPrice, big.NewInt(100))
+	if gasPrice.Cmp(minGasPrice) == -1 {
+		return nil, fmt.Errorf("gas price %v is capped at MaxGasPrice %v", last, gasPrice)
+	}
+	return gasPrice, nil
+}
@@ -0,0 +1,176 @@
+package loaders
+
+import (
+	"context"
+	"math/big"
+	"testing"
+
+	ethkeystore "github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/iden3/go-iden3-core/components/idenpubonchain"
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/iden3/go-iden3-core/eth"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTxWatchdog(t *testing.T, client *eth.Client, ks *ethkeystore.KeyStore,
+	gasPolicy *GasPolicy, storage db.Storage) *TxWatchdog {
+	cfg := &config.Gas{StuckBlocks: 5}
+	w, err := NewTxWatchdog(idenpubonchain.New(client, idenpubonchain.ContractAddresses{}),
+		client, ks, 1337, cfg, gasPolicy, storage)
+	require.Nil(t, err)
+	return w
+}
+
+// sendTestTx sends a state transition like transaction with gasPrice and
+// tracks it in w.
+func sendTestTx(t *testing.T, w *TxWatchdog, gasPrice int64) *types.Transaction {
+	tx, err := w.ks.SignTx(*w.account, types.NewTransaction(0, common.HexToAddress("0x01"),
+		big.NewInt(0), idenStatesGasLimit, big.NewInt(gasPrice), []byte("setState")), w.chainId)
+	require.Nil(t, err)
+	require.Nil(t, w.client.Call(func(c *ethclient.Client) error {
+		return c.SendTransaction(context.Background(), tx)
+	}))
+	require.Nil(t, w.track(tx))
+	return tx
+}
+
+func pendingTxs(t *testing.T, w *TxWatchdog) []*types.Transaction {
+	pending, err := w.load()
+	require.Nil(t, err)
+	require.NotNil(t, pending)
+	return pending.Txs
+}
+
+func TestTxWatchdogReplace(t *testing.T) {
+	backend, server := newSimBackend(t, 100)
+	defer server.Close()
+	client, ks, _, remove := newTestEthClient(t, server.URL)
+	defer remove()
+	w := newTestTxWatchdog(t, client, ks, nil, db.NewMemoryStorage())
+	tx := sendTestTx(t, w, 10000000000)
+
+	// Not stuck yet
+	backend.advance(4)
+	require.Nil(t, w.Check())
+	require.Equal(t, 1, backend.sentTxs())
+	require.Equal(t, 1, len(pendingTxs(t, w)))
+
+	// Stuck: replaced with the same nonce and the gas price bumped 12%
+	backend.advance(1)
+	require.Nil(t, w.Check())
+	require.Equal(t, 2, backend.sentTxs())
+	txs := pendingTxs(t, w)
+	require.Equal(t, 2, len(txs))
+	require.Equal(t, tx.Hash(), txs[0].Hash())
+	require.Equal(t, tx.Nonce(), txs[1].Nonce())
+	require.Equal(t, tx.Data(), txs[1].Data())
+	require.Equal(t, big.NewInt(11200000000), txs[1].GasPrice())
+
+	// The suggested gas price is used when higher than the bump
+	backend.mutex.Lock()
+	backend.gasPrice = big.NewInt(20000000000)
+	backend.mutex.Unlock()
+	backend.advance(5)
+	require.Nil(t, w.Check())
+	txs = pendingTxs(t, w)
+	require.Equal(t, 3, len(txs))
+	require.Equal(t, big.NewInt(20200000000), txs[2].GasPrice())
+
+	// The replacement is mined, and the issuer sees the confirmations of
+	// its original transaction
+	_, err := w.TxConfirmBlocks(tx)
+	require.Equal(t, eth.ErrReceiptNotReceived, err)
+	backend.mine(t, txs[1])
+	backend.advance(3)
+	confirmBlocks, err := w.TxConfirmBlocks(tx)
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(3), confirmBlocks)
+	backend.advance(10)
+	require.Nil(t, w.Check())
+	require.Equal(t, 3, backend.sentTxs())
+}
+
+func TestTxWatchdogMaxGasPrice(t *testing.T) {
+	backend, server := newSimBackend(t, 100)
+	defer server.Close()
+	client, ks, _, remove := newTestEthClient(t, server.URL)
+	defer remove()
+	var gas config.Gas
+	gas.MaxGasPrice.SetInt64(11100000000)
+	w := newTestTxWatchdog(t, client, ks, NewGasPolicy(&gas), db.NewMemoryStorage())
+	sendTestTx(t, w, 10000000000)
+
+	// The bump is capped at MaxGasPrice
+	backend.advance(5)
+	require.Nil(t, w.Check())
+	txs := pendingTxs(t, w)
+	require.Equal(t, 2, len(txs))
+	require.Equal(t, big.NewInt(11100000000), txs[1].GasPrice())
+
+	// A replacement below the minimum bump accepted by the nodes is not
+	// sent
+	backend.advance(5)
+	err := w.Check()
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "MaxGasPrice")
+	require.Equal(t, 2, backend.sentTxs())
+	require.Equal(t, 2, len(pendingTxs(t, w)))
+}
+
+func TestTxWatchdogOriginalMined(t *testing.T) {
+	backend, server := newSimBackend(t, 100)
+	defer server.Close()
+	client, ks, _, remove := newTestEthClient(t, server.URL)
+	defer remove()
+	w := newTestTxWatchdog(t, client, ks, nil, db.NewMemoryStorage())
+	tx := sendTestTx(t, w, 10000000000)
+	backend.advance(5)
+	require.Nil(t, w.Check())
+	require.Equal(t, 2, backend.sentTxs())
+
+	// The original is mined after the replacement was sent: nothing else is
+	// sent, and the replacement can't be mined anymore
+	backend.mine(t, tx)
+	backend.advance(10)
+	require.Nil(t, w.Check())
+	require.Equal(t, 2, backend.sentTxs())
+	confirmBlocks, err := w.TxConfirmBlocks(tx)
+	require.Nil(t, err)
+	require.Equal(t, big.NewInt(10), confirmBlocks)
+}
+
+func TestTxWatchdogRestart(t *testing.T) {
+	backend, server := newSimBackend(t, 100)
+	defer server.Close()
+	client, ks, _, remove := newTestEthClient(t, server.URL)
+	defer remove()
+	storage := db.NewMemoryStorage()
+	w := newTestTxWatchdog(t, client, ks, nil, storage)
+	tx := sendTestTx(t, w, 10000000000)
+	backend.advance(5)
+	require.Nil(t, w.Check())
+
+	// A new TxWatchdog resumes from the stored pending transaction: it
+	// waits StuckBlocks since the last replacement, and replaces the last
+	// one
+	w = newTestTxWatchdog(t, client, ks, nil, storage)
+	backend.advance(4)
+	require.Nil(t, w.Check())
+	require.Equal(t, 2, backend.sentTxs())
+	backend.advance(1)
+	require.Nil(t, w.Check())
+	txs := pendingTxs(t, w)
+	require.Equal(t, 3, len(txs))
+	require.Equal(t, tx.Hash(), txs[0].Hash())
+	require.Equal(t, tx.Nonce(), txs[2].Nonce())
+	require.Equal(t, big.NewInt(12544000000), txs[2].GasPrice())
+
+	backend.mine(t, txs[2])
+	confirmBlocks, err := w.TxConfirmBlocks(tx)
+	require.Nil(t, err)
+	require.Equal(t, int64(0), confirmBlocks.Int64())
+}
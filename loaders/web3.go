@@ -0,0 +1,171 @@
+package loaders
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/iden3/go-iden3-servers/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// web3Transport is an http.RoundTripper that sends the requests to the real
+// web3 endpoint url, adding the configured headers and basic auth, and
+// retrying failed requests other than transaction sends.  The rpc client is dialed with a redacted url so
+// that errors created by the http client never contain the real url.
+type web3Transport struct {
+	endpoint *config.Web3Endpoint
+	url      *url.URL
+	base     http.RoundTripper
+}
+
+func (t *web3Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	retries := t.endpoint.Retries
+	if isSendTransaction(body) {
+		retries = 0
+	}
+	var res *http.Response
+	var err error
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			log.WithField("url", t.endpoint.String()).WithField("attempt", attempt).
+				WithField("err", err).Warn("Retrying web3 request")
+			select {
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			case <-time.After(t.endpoint.RetryDelay.Duration):
+			}
+		}
+		r := req.Clone(req.Context())
+		r.URL = t.url
+		r.Host = t.url.Host
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		for k, v := range t.endpoint.Headers {
+			r.Header.Set(k, v.Value)
+		}
+		if auth := t.endpoint.BasicAuth; auth != nil {
+			r.SetBasicAuth(auth.Username, auth.Password.Value)
+		}
+		res, err = t.roundTripTimeout(r)
+		if err != nil {
+			continue
+		}
+		if res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+			return res, nil
+		}
+		if attempt < retries {
+			res.Body.Close()
+		}
+		err = fmt.Errorf("http status %v", res.Status)
+	}
+	if res != nil {
+		return res, nil
+	}
+	return nil, fmt.Errorf("web3 request to %v failed after %v attempts: %v",
+		t.endpoint, retries+1, stripUrl(err, t.url))
+}
+
+// isSendTransaction returns true if the json-rpc request body sends a
+// transaction.  A failed send may have reached the node anyway, so it's not
+// retried: the resend would fail with "already known" or "nonce too low", and
+// the transaction could be sent twice through different endpoints.
+func isSendTransaction(body []byte) bool {
+	type message struct {
+		Method string `json:"method"`
+	}
+	var msgs []message
+	if err := json.Unmarshal(body, &msgs); err != nil {
+		var msg message
+		if err := json.Unmarshal(body, &msg); err != nil {
+			return false
+		}
+		msgs = []message{msg}
+	}
+	for _, msg := range msgs {
+		if msg.Method == "eth_sendRawTransaction" || msg.Method == "eth_sendTransaction" {
+			return true
+		}
+	}
+	return false
+}
+
+// roundTripTimeout performs the request limiting its duration to the
+// endpoint Timeout.
+func (t *web3Transport) roundTripTimeout(req *http.Request) (*http.Response, error) {
+	if t.endpoint.Timeout.Duration == 0 {
+		return t.base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.endpoint.Timeout.Duration)
+	res, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelReadCloser{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// cancelReadCloser cancels the request context once the response body is
+// closed.
+type cancelReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelReadCloser) Close() error {
+	defer c.cancel()
+	return c.ReadCloser.Close()
+}
+
+// stripUrl returns the message of err with the occurrences of u removed.
+func stripUrl(err error, u *url.URL) string {
+	return strings.ReplaceAll(err.Error(), u.String(), "(redacted)")
+}
+
+// DialWeb3 opens a connection to the web3 endpoint.
+func DialWeb3(endpoint *config.Web3Endpoint) (*rpc.Client, error) {
+	rawUrl := endpoint.RawUrl()
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid web3 url %v", endpoint)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		if len(endpoint.Headers) != 0 || endpoint.BasicAuth != nil || endpoint.Timeout.Duration != 0 ||
+			endpoint.Retries != 0 || endpoint.RetryDelay.Duration != 0 {
+			return nil, fmt.Errorf("Headers, BasicAuth, Timeout, Retries and RetryDelay " +
+				"are only supported for http(s) web3 urls")
+		}
+		client, err := rpc.Dial(rawUrl)
+		if err != nil {
+			return nil, fmt.Errorf("Error dialing web3 %v: %v", endpoint, stripUrl(err, u))
+		}
+		return client, nil
+	}
+	httpClient := &http.Client{Transport: newWeb3Transport(endpoint, u)}
+	// The real url is set by web3Transport
+	return rpc.DialHTTPWithClient(fmt.Sprintf("%v://web3", u.Scheme), httpClient)
+}
+
+func newWeb3Transport(endpoint *config.Web3Endpoint, u *url.URL) *web3Transport {
+	return &web3Transport{
+		endpoint: endpoint,
+		url:      u,
+		base:     http.DefaultTransport,
+	}
+}
@@ -0,0 +1,373 @@
+package loaders
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/ethereum/go-ethereum/rpc"
+	"github.com/iden3/go-iden3-servers/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	web3HealthCheckPeriodDefault  = 30 * time.Second
+	web3HealthCheckTimeout        = 5 * time.Second
+	web3MaxBlockLagDefault        = 5
+	web3MaxErrorRateDefault       = 0.5
+	web3ErrorRateSmoothingFactor  = 0.2
+	web3StatusHealthy             = "healthy"
+	web3StatusUnhealthyBlockLag   = "block height lag"
+	web3StatusUnhealthyErrorRate  = "error rate"
+	web3StatusUnhealthyNotChecked = "not checked"
+	web3StatusUnhealthyNoReply    = "unreachable"
+)
+
+// web3PoolEndpoint is a web3 endpoint of the pool with its health
+// information.
+type web3PoolEndpoint struct {
+	cfg       *config.Web3Endpoint
+	transport http.RoundTripper
+	client    *rpc.Client
+	height    uint64
+	errorRate float64
+	status    string
+}
+
+func (e *web3PoolEndpoint) healthy() bool { return e.status == web3StatusHealthy }
+
+// Web3EndpointStatus is the health information of a web3 endpoint.
+type Web3EndpointStatus struct {
+	Url       string  `json:"url"`
+	Current   bool    `json:"current"`
+	Status    string  `json:"status"`
+	Height    uint64  `json:"height"`
+	ErrorRate float64 `json:"errorRate"`
+}
+
+// Web3Pool is a set of web3 endpoints behind a single rpc client.  Requests
+// are sent to the current endpoint, and when they fail, to the next healthiest
+// endpoint, which then becomes the current one.  The current endpoint is kept
+// while it's healthy.  Endpoints are checked periodically once Start is
+// called.
+type Web3Pool struct {
+	rw          sync.RWMutex
+	endpoints   []*web3PoolEndpoint
+	current     *web3PoolEndpoint
+	client      *rpc.Client
+	cfg         config.Web3HealthCheck
+	stopch      chan (interface{})
+	stoppedch   chan (interface{})
+	healthCheck bool
+}
+
+// NewWeb3Pool creates a Web3Pool with the endpoints of the web3
+// configuration.  With more than one endpoint, all of them must be http(s).
+func NewWeb3Pool(cfg *config.Web3) (*Web3Pool, error) {
+	p := &Web3Pool{
+		cfg:       cfg.HealthCheck,
+		stopch:    make(chan (interface{})),
+		stoppedch: make(chan (interface{})),
+	}
+	if p.cfg.Period.Duration == 0 {
+		p.cfg.Period.Duration = web3HealthCheckPeriodDefault
+	}
+	if p.cfg.MaxBlockLag == 0 {
+		p.cfg.MaxBlockLag = web3MaxBlockLagDefault
+	}
+	if p.cfg.MaxErrorRate == 0 {
+		p.cfg.MaxErrorRate = web3MaxErrorRateDefault
+	}
+	endpoints := cfg.AllEndpoints()
+	for i := range endpoints {
+		endpoint := &endpoints[i]
+		client, err := DialWeb3(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		e := &web3PoolEndpoint{cfg: endpoint, client: client,
+			status: web3StatusUnhealthyNotChecked}
+		u, err := url.Parse(endpoint.RawUrl())
+		if err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			e.transport = newWeb3Transport(endpoint, u)
+		} else if len(endpoints) > 1 {
+			return nil, fmt.Errorf("Web3 endpoint %v: only http(s) urls "+
+				"are supported with multiple endpoints", endpoint)
+		}
+		p.endpoints = append(p.endpoints, e)
+	}
+	p.current = p.endpoints[0]
+	if p.current.transport == nil {
+		// Single non-http endpoint
+		p.client = p.current.client
+		return p, nil
+	}
+	p.healthCheck = len(p.endpoints) > 1
+	client, err := rpc.DialHTTPWithClient("http://web3pool", &http.Client{Transport: p})
+	if err != nil {
+		return nil, err
+	}
+	p.client = client
+	return p, nil
+}
+
+// Client returns the rpc client that sends the requests to the pool.
+func (p *Web3Pool) Client() *rpc.Client {
+	return p.client
+}
+
+// Current returns the configuration of the endpoint currently in use.
+func (p *Web3Pool) Current() *config.Web3Endpoint {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	return p.current.cfg
+}
+
+// Status returns the health information of every endpoint.
+func (p *Web3Pool) Status() []Web3EndpointStatus {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	status := make([]Web3EndpointStatus, len(p.endpoints))
+	for i, e := range p.endpoints {
+		status[i] = Web3EndpointStatus{
+			Url:       e.cfg.String(),
+			Current:   e == p.current,
+			Status:    e.status,
+			Height:    e.height,
+			ErrorRate: e.errorRate,
+		}
+	}
+	return status
+}
+
+// CheckChainId checks that every endpoint is connected to the chain with the
+// expected chainId and returns it.  If chainId is 0, it only checks that all
+// the endpoints are connected to the same chain, and returns its chain ID.
+func (p *Web3Pool) CheckChainId(chainId uint64) (uint64, error) {
+	for i, e := range p.endpoints {
+		ctx, cancel := context.WithTimeout(context.Background(), web3HealthCheckTimeout)
+		endpointChainId, err := ethclient.NewClient(e.client).ChainID(ctx)
+		cancel()
+		if err != nil {
+			return 0, fmt.Errorf("Error getting chain ID of web3 endpoint %v: %w", e.cfg, err)
+		}
+		if !endpointChainId.IsUint64() {
+			return 0, fmt.Errorf("Web3 endpoint %v chain ID %v is too big", e.cfg, endpointChainId)
+		}
+		if i == 0 && chainId == 0 {
+			chainId = endpointChainId.Uint64()
+			log.WithField("chainId", chainId).Warn("Web3.ChainId not configured, using the one of the web3 endpoint")
+		}
+		if endpointChainId.Uint64() != chainId {
+			return 0, fmt.Errorf("Web3 endpoint %v is connected to chain ID %v, but %v was expected",
+				e.cfg, endpointChainId, chainId)
+		}
+	}
+	log.WithField("chainId", chainId).Info("Web3 chain ID checked successfully")
+	return chainId, nil
+}
+
+// candidates returns the endpoints in the order they must be tried: the
+// current one first and the rest from healthiest to least healthy.
+func (p *Web3Pool) candidates() []*web3PoolEndpoint {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+	candidates := []*web3PoolEndpoint{p.current}
+	for _, e := range p.byHealth() {
+		if e != p.current {
+			candidates = append(candidates, e)
+		}
+	}
+	return candidates
+}
+
+// byHealth returns the endpoints sorted from healthiest to least healthy.
+// Endpoints with the same health keep the configuration order.
+func (p *Web3Pool) byHealth() []*web3PoolEndpoint {
+	sorted := make([]*web3PoolEndpoint, len(p.endpoints))
+	copy(sorted, p.endpoints)
+	var maxHeight uint64
+	for _, e := range sorted {
+		if e.height > maxHeight {
+			maxHeight = e.height
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.healthy() != b.healthy() {
+			return a.healthy()
+		}
+		if a.errorRate != b.errorRate {
+			return a.errorRate < b.errorRate
+		}
+		return maxHeight-a.height < maxHeight-b.height
+	})
+	return sorted
+}
+
+// report updates the error rate of the endpoint with the result of a request.
+// If the request failed, the pool fails over to the healthiest endpoint.
+func (p *Web3Pool) report(e *web3PoolEndpoint, ok bool) {
+	p.rw.Lock()
+	defer p.rw.Unlock()
+	failed := 0.0
+	if !ok {
+		failed = 1.0
+	}
+	e.errorRate = e.errorRate*(1-web3ErrorRateSmoothingFactor) + failed*web3ErrorRateSmoothingFactor
+	if e.healthy() && e.errorRate > p.cfg.MaxErrorRate {
+		e.status = web3StatusUnhealthyErrorRate
+	}
+	if !ok && e == p.current {
+		for _, next := range p.byHealth() {
+			if next != e {
+				p.switchTo(next, "request failed")
+				break
+			}
+		}
+	}
+}
+
+// switchTo sets the current endpoint.  Must be called with the lock held.
+func (p *Web3Pool) switchTo(e *web3PoolEndpoint, reason string) {
+	if e == p.current {
+		return
+	}
+	log.WithField("from", p.current.cfg).WithField("to", e.cfg).
+		WithField("reason", reason).Warn("Web3 endpoint failover")
+	p.current = e
+}
+
+// RoundTrip sends the request to the current endpoint, failing over to the
+// other endpoints until one succeeds.  Transaction sends are only tried on the
+// current endpoint, see isSendTransaction.
+func (p *Web3Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = ioutil.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		req.Body.Close()
+	}
+	candidates := p.candidates()
+	if isSendTransaction(body) {
+		candidates = candidates[:1]
+	}
+	var err error
+	for _, e := range candidates {
+		r := req.Clone(req.Context())
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var res *http.Response
+		res, err = e.transport.RoundTrip(r)
+		if err == nil && res.StatusCode < 500 && res.StatusCode != http.StatusTooManyRequests {
+			p.report(e, true)
+			return res, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("web3 request to %v failed: http status %v", e.cfg, res.Status)
+			res.Body.Close()
+		}
+		p.report(e, false)
+		if req.Context().Err() != nil {
+			break
+		}
+	}
+	return nil, fmt.Errorf("all web3 endpoints failed, last error: %w", err)
+}
+
+// Check queries the block height of every endpoint and updates their health.
+// If the current endpoint is unhealthy, the pool fails over to the
+// healthiest one.
+func (p *Web3Pool) Check() {
+	heights := make([]uint64, len(p.endpoints))
+	errs := make([]error, len(p.endpoints))
+	var wg sync.WaitGroup
+	for i, e := range p.endpoints {
+		wg.Add(1)
+		go func(i int, e *web3PoolEndpoint) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), web3HealthCheckTimeout)
+			defer cancel()
+			var height hexutil.Uint64
+			errs[i] = e.client.CallContext(ctx, &height, "eth_blockNumber")
+			heights[i] = uint64(height)
+		}(i, e)
+	}
+	wg.Wait()
+
+	var maxHeight uint64
+	for i := range p.endpoints {
+		if errs[i] == nil && heights[i] > maxHeight {
+			maxHeight = heights[i]
+		}
+	}
+	for i, e := range p.endpoints {
+		p.report(e, errs[i] == nil)
+		p.rw.Lock()
+		if errs[i] == nil {
+			e.height = heights[i]
+		}
+		switch {
+		case e.errorRate > p.cfg.MaxErrorRate:
+			e.status = web3StatusUnhealthyErrorRate
+		case errs[i] != nil:
+			e.status = web3StatusUnhealthyNoReply
+		case maxHeight-e.height > p.cfg.MaxBlockLag:
+			e.status = web3StatusUnhealthyBlockLag
+		default:
+			e.status = web3StatusHealthy
+		}
+		log.WithField("url", e.cfg).WithField("height", e.height).
+			WithField("errorRate", e.errorRate).WithField("status", e.status).
+			WithField("err", errs[i]).Debug("Web3 endpoint health check")
+		p.rw.Unlock()
+	}
+
+	p.rw.Lock()
+	if !p.current.healthy() {
+		p.switchTo(p.byHealth()[0], fmt.Sprintf("unhealthy: %v", p.current.status))
+	}
+	p.rw.Unlock()
+}
+
+// Start runs the periodic health check of the endpoints.  It does nothing if
+// the pool has a single endpoint.
+func (p *Web3Pool) Start() {
+	if !p.healthCheck {
+		return
+	}
+	p.Check()
+	go func() {
+		log.Info("Starting periodic Web3 endpoints health check")
+		for {
+			select {
+			case <-p.stopch:
+				log.Info("Web3 endpoints health check finalized")
+				p.stoppedch <- nil
+				return
+			case <-time.After(p.cfg.Period.Duration):
+				p.Check()
+			}
+		}
+	}()
+}
+
+// StopAndJoin stops the periodic health check started by Start.
+func (p *Web3Pool) StopAndJoin() {
+	if !p.healthCheck {
+		return
+	}
+	go func() {
+		p.stopch <- nil
+	}()
+	<-p.stoppedch
+}
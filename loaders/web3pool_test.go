@@ -0,0 +1,221 @@
+package loaders
+
+import (
+	"context"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	ethkeystore "github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWeb3PoolFailover(t *testing.T) {
+	_, server0 := newSimBackend(t, 100)
+	defer server0.Close()
+	backend1, server1 := newSimBackend(t, 90)
+	defer server1.Close()
+	_, server2 := newSimBackend(t, 100)
+	defer server2.Close()
+
+	var cfg config.Web3
+	cfg.Url = server0.URL
+	cfg.Endpoints = []config.Web3Endpoint{{Url: server1.URL}, {Url: server2.URL}}
+	pool, err := NewWeb3Pool(&cfg)
+	require.Nil(t, err)
+	client := pool.Client()
+
+	blockNumber := func() uint64 {
+		var height hexutil.Uint64
+		require.Nil(t, client.CallContext(context.Background(), &height, "eth_blockNumber"))
+		return uint64(height)
+	}
+
+	pool.Check()
+	status := pool.Status()
+	require.Equal(t, web3StatusHealthy, status[0].Status)
+	require.Equal(t, web3StatusUnhealthyBlockLag, status[1].Status)
+	require.Equal(t, web3StatusHealthy, status[2].Status)
+	require.Equal(t, uint64(100), blockNumber())
+	require.Equal(t, server0.URL, pool.Current().Url)
+
+	// The first endpoint goes down: the request fails over to the
+	// healthiest one, skipping the lagging endpoint.
+	server0.Close()
+	require.Equal(t, uint64(100), blockNumber())
+	require.Equal(t, server2.URL, pool.Current().Url)
+	calls1 := atomic.LoadInt64(&backend1.calls)
+
+	// The lagging endpoint catches up, but the current endpoint is kept
+	// while it's healthy.
+	atomic.StoreUint64(&backend1.height, 100)
+	pool.Check()
+	require.Equal(t, web3StatusUnhealthyNoReply, pool.Status()[0].Status)
+	require.Equal(t, web3StatusHealthy, pool.Status()[1].Status)
+	require.Equal(t, uint64(100), blockNumber())
+	require.Equal(t, server2.URL, pool.Current().Url)
+	require.Equal(t, calls1+1, atomic.LoadInt64(&backend1.calls)) // Only the health check
+
+	// The current endpoint lags behind, so the pool fails over to the
+	// healthy one.
+	atomic.StoreUint64(&backend1.height, 120)
+	pool.Check()
+	require.Equal(t, server1.URL, pool.Current().Url)
+	require.Equal(t, uint64(120), blockNumber())
+
+	// All endpoints down
+	server1.Close()
+	server2.Close()
+	var height hexutil.Uint64
+	err = client.CallContext(context.Background(), &height, "eth_blockNumber")
+	require.NotNil(t, err)
+}
+
+func TestDialWeb3NonHttpOptions(t *testing.T) {
+	for _, endpoint := range []config.Web3Endpoint{
+		{Url: "ws://localhost:8546", Retries: 2},
+		{Url: "ws://localhost:8546", Timeout: config.Duration{Duration: time.Second}},
+		{Url: "/tmp/geth.ipc", RetryDelay: config.Duration{Duration: time.Second}},
+		{Url: "/tmp/geth.ipc", BasicAuth: &config.BasicAuth{Username: "user"}},
+	} {
+		_, err := DialWeb3(&endpoint)
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "only supported for http(s)")
+	}
+}
+
+func TestWeb3PoolCheckChainId(t *testing.T) {
+	_, server0 := newSimBackend(t, 100)
+	defer server0.Close()
+	backend1, server1 := newSimBackend(t, 100)
+	defer server1.Close()
+
+	var cfg config.Web3
+	cfg.Url = server0.URL
+	cfg.Endpoints = []config.Web3Endpoint{{Url: server1.URL}}
+	pool, err := NewWeb3Pool(&cfg)
+	require.Nil(t, err)
+
+	chainId, err := pool.CheckChainId(1337)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1337), chainId)
+	_, err = pool.CheckChainId(1)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "connected to chain ID 1337, but 1 was expected")
+
+	// Without the expected chain ID, the one of the main endpoint is used
+	chainId, err = pool.CheckChainId(0)
+	require.Nil(t, err)
+	require.Equal(t, uint64(1337), chainId)
+
+	// A failover endpoint connected to another chain
+	backend1.mutex.Lock()
+	backend1.chainId = big.NewInt(5)
+	backend1.mutex.Unlock()
+	_, err = pool.CheckChainId(1337)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), server1.URL)
+	_, err = pool.CheckChainId(0)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "connected to chain ID 5, but 1337 was expected")
+}
+
+// newLossyProxy returns a web3 endpoint that forwards the requests to url,
+// and replies with an error instead of the response.
+func newLossyProxy(t *testing.T, url string, requests *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(requests, 1)
+		res, err := http.Post(url, r.Header.Get("Content-Type"), r.Body)
+		require.Nil(t, err)
+		res.Body.Close()
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+}
+
+// newTestSignedTx returns a transaction signed by a new account in a
+// temporary keystore, removed by the returned function.
+func newTestSignedTx(t *testing.T) (*types.Transaction, func()) {
+	dir, err := ioutil.TempDir("", "keystore")
+	require.Nil(t, err)
+	ks := ethkeystore.NewKeyStore(dir, ethkeystore.LightScryptN, ethkeystore.LightScryptP)
+	acc, err := ks.NewAccount("pass")
+	require.Nil(t, err)
+	tx, err := ks.SignTxWithPassphrase(acc, "pass", types.NewTransaction(0, acc.Address,
+		big.NewInt(0), 21000, big.NewInt(1), nil), big.NewInt(1337))
+	require.Nil(t, err)
+	return tx, func() { os.RemoveAll(dir) }
+}
+
+func TestWeb3SendTransactionNoRetry(t *testing.T) {
+	backend, server := newSimBackend(t, 100)
+	defer server.Close()
+	var requests int64
+	proxy := newLossyProxy(t, server.URL, &requests)
+	defer proxy.Close()
+	rpcClient, err := DialWeb3(&config.Web3Endpoint{Url: proxy.URL, Retries: 2})
+	require.Nil(t, err)
+	client := ethclient.NewClient(rpcClient)
+
+	_, err = client.BlockByNumber(context.Background(), nil)
+	require.Error(t, err)
+	require.Equal(t, int64(3), atomic.LoadInt64(&requests))
+
+	// The transaction reaches the node but the response is lost: it's not
+	// sent again
+	tx, remove := newTestSignedTx(t)
+	defer remove()
+	err = client.SendTransaction(context.Background(), tx)
+	require.Error(t, err)
+	require.Equal(t, int64(4), atomic.LoadInt64(&requests))
+	require.Equal(t, 1, backend.sentTxs())
+}
+
+func TestWeb3PoolSendTransactionNoRetry(t *testing.T) {
+	backend0, server0 := newSimBackend(t, 100)
+	defer server0.Close()
+	backend1, server1 := newSimBackend(t, 100)
+	defer server1.Close()
+	var requests0, requests1 int64
+	proxy0 := newLossyProxy(t, server0.URL, &requests0)
+	defer proxy0.Close()
+	proxy1 := newLossyProxy(t, server1.URL, &requests1)
+	defer proxy1.Close()
+
+	var cfg config.Web3
+	cfg.Url = proxy0.URL
+	cfg.Retries = 2
+	cfg.Endpoints = []config.Web3Endpoint{{Url: proxy1.URL, Retries: 2}}
+	pool, err := NewWeb3Pool(&cfg)
+	require.Nil(t, err)
+	client := ethclient.NewClient(pool.Client())
+
+	// Other requests are retried and failed over, and the pool fails back
+	// to the first endpoint
+	_, err = client.BlockByNumber(context.Background(), nil)
+	require.Error(t, err)
+	require.Equal(t, int64(3), atomic.LoadInt64(&requests0))
+	require.Equal(t, int64(3), atomic.LoadInt64(&requests1))
+	require.Equal(t, proxy0.URL, pool.Current().Url)
+
+	// The transaction reaches the node but the response is lost: it's not
+	// sent again, neither to the same endpoint nor to another one, but the
+	// pool still fails over
+	tx, remove := newTestSignedTx(t)
+	defer remove()
+	err = client.SendTransaction(context.Background(), tx)
+	require.Error(t, err)
+	require.Equal(t, int64(4), atomic.LoadInt64(&requests0))
+	require.Equal(t, int64(3), atomic.LoadInt64(&requests1))
+	require.Equal(t, 1, backend0.sentTxs())
+	require.Equal(t, 0, backend1.sentTxs())
+	require.Equal(t, proxy1.URL, pool.Current().Url)
+}
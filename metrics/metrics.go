@@ -0,0 +1,37 @@
+package metrics
+
+import (
+	"net/http"
+
+	gethmetrics "github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/metrics/prometheus"
+)
+
+// Registry contains the metrics of the server, exposed by Handler.
+var Registry = gethmetrics.NewRegistry()
+
+func init() {
+	// The metrics constructors return stubs unless metrics are enabled.
+	gethmetrics.Enabled = true
+}
+
+// NewGauge creates a new Gauge registered in the Registry.
+func NewGauge(name string) gethmetrics.Gauge {
+	return gethmetrics.NewRegisteredGauge(name, Registry)
+}
+
+// NewTimer creates a new Timer registered in the Registry.
+func NewTimer(name string) gethmetrics.Timer {
+	return gethmetrics.NewRegisteredTimer(name, Registry)
+}
+
+// NewCounter creates a new Counter registered in the Registry.
+func NewCounter(name string) gethmetrics.Counter {
+	return gethmetrics.NewRegisteredCounter(name, Registry)
+}
+
+// Handler returns an http.Handler that serves the metrics of the Registry in
+// the prometheus format.
+func Handler() http.Handler {
+	return prometheus.Handler(Registry)
+}
@@ -1,13 +1,17 @@
 package serve
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"github.com/iden3/go-iden3-core/core"
+	"github.com/iden3/go-iden3-servers/handlers"
 	"github.com/iden3/go-iden3-servers/loaders"
+	"github.com/iden3/go-iden3-servers/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -17,6 +21,29 @@ func WithServer(srv *loaders.Server, handler func(c *gin.Context, srv *loaders.S
 	}
 }
 
+// WithIdentity calls the handler with the hosted identity of the :id route
+// parameter, or with the main identity if the route has no :id.
+func WithIdentity(srv *loaders.Server,
+	handler func(c *gin.Context, srv *loaders.Server, iden *loaders.Identity)) func(c *gin.Context) {
+	return func(c *gin.Context) {
+		iden := srv.Identities()[0]
+		if idStr := c.Param("id"); idStr != "" {
+			id, err := core.IDFromString(idStr)
+			if err != nil {
+				handlers.Fail(c, "Invalid identity", err)
+				return
+			}
+			if iden = srv.Identity(&id); iden == nil {
+				c.JSON(http.StatusNotFound, gin.H{
+					"error": fmt.Sprintf("Identity %v not hosted", &id),
+				})
+				return
+			}
+		}
+		handler(c, srv, iden)
+	}
+}
+
 func handleNoRoute(c *gin.Context) {
 	c.JSON(404, gin.H{
 		"error": "404 page not found",
@@ -45,6 +72,7 @@ func NewAdminAPI(prefix string, stopch chan interface{}, srv *loaders.Server) (*
 		c.String(http.StatusOK, "got it, shutdowning server")
 		stopch <- nil
 	})
+	adminapi.GET("/metrics", gin.WrapH(metrics.Handler()))
 
 	// TODO: Reenable once HandleInfo is available again
 	//adminapi.GET("/info", HandleInfo)
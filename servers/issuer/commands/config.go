@@ -0,0 +1,23 @@
+package commands
+
+import (
+	"github.com/iden3/go-iden3-servers/cmd"
+	"github.com/iden3/go-iden3-servers/config"
+	"github.com/urfave/cli"
+)
+
+var ConfigCommands = []cli.Command{{
+	Name:  "config",
+	Usage: "inspect the configuration",
+	Subcommands: []cli.Command{
+		{
+			Name:  "show",
+			Usage: "print the resolved configuration with the secrets redacted",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "format", Value: config.FormatTOML,
+					Usage: "Options: " + config.FormatTOML + ", " + config.FormatJSON},
+			},
+			Action: cmd.WithCfg(cmd.CmdConfigShow),
+		},
+	},
+}}
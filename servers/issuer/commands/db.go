@@ -1,8 +1,11 @@
 package commands
 
 import (
+	"strings"
+
 	"github.com/iden3/go-iden3-servers/cmd"
 	"github.com/iden3/go-iden3-servers/config"
+	"github.com/iden3/go-iden3-servers/inspect"
 	"github.com/urfave/cli"
 )
 
@@ -14,14 +17,93 @@ var DbCommands = []cli.Command{{
 			Name:  "rawdump",
 			Usage: "dump database raw key values",
 			Action: cmd.WithCfg(func(c *cli.Context, cfg *config.Config) error {
-				return cmd.CmdDbRawDump(c, cfg.Storage.Path)
+				return cmd.CmdDbRawDump(c, &cfg.Storage)
+			}),
+		},
+		{
+			Name:  "inspect",
+			Usage: "print the decoded database key values as JSON",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "id", Usage: "only print the keys of this identity"},
+				cli.StringFlag{Name: "kind", Usage: "comma separated kinds to print: " +
+					strings.Join(inspect.Kinds, ",")},
+			},
+			Action: cmd.WithCfg(func(c *cli.Context, cfg *config.Config) error {
+				return cmd.CmdDbInspect(c, &cfg.Storage)
+			}),
+		},
+		{
+			Name:  "verify",
+			Usage: "verify the merkle trees and identity states, failing on corruption",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "id", Usage: "only verify this identity"},
+			},
+			Action: cmd.WithCfg(func(c *cli.Context, cfg *config.Config) error {
+				return cmd.CmdDbVerify(c, &cfg.Storage)
+			}),
+		},
+		{
+			Name:  "migrate",
+			Usage: "migrate the database to the current schema version, after a backup",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "dry-run", Usage: "only print the pending migrations"},
+			},
+			Action: cmd.WithCfg(cmd.CmdDbMigrate),
+		},
+		{
+			Name:      "rawimport",
+			Usage:     "import database raw key values from a rawdump file",
+			ArgsUsage: "<file>",
+			Flags: []cli.Flag{
+				cli.BoolFlag{Name: "dry-run", Usage: "validate and report without importing"},
+				cli.StringFlag{Name: "prefix", Usage: "only import the keys with this prefix"},
+				cli.BoolFlag{Name: "force", Usage: "overwrite existing keys with different values"},
+			},
+			Action: cmd.WithCfg(func(c *cli.Context, cfg *config.Config) error {
+				return cmd.CmdDbRawImport(c, &cfg.Storage)
+			}),
+		},
+		{
+			Name:      "backup",
+			Usage:     "write a backup archive of the database, online if the server is running",
+			ArgsUsage: "<file>",
+			Action:    cmd.WithCfg(cmd.CmdDbBackup),
+		},
+		{
+			Name:      "restore",
+			Usage:     "replace the database with a verified backup archive",
+			ArgsUsage: "<file>",
+			Action:    cmd.WithCfg(cmd.CmdDbRestore),
+		},
+		{
+			Name:      "export-car",
+			Usage:     "export the identity data to a CAR file rooted at its state",
+			ArgsUsage: "<file>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "id", Usage: "identity to export (default the configured one)"},
+			},
+			Action: cmd.WithCfg(cmd.CmdDbExportCar),
+		},
+		{
+			Name:      "import-car",
+			Usage:     "import and verify the identity data of a CAR file",
+			ArgsUsage: "<file>",
+			Action: cmd.WithCfg(func(c *cli.Context, cfg *config.Config) error {
+				return cmd.CmdDbImportCar(c, &cfg.Storage)
 			}),
 		},
 		{
 			Name:  "ipfsexport",
 			Usage: "export database values to ipfs",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "api", Usage: "ipfs api address, overrides Ipfs.Api"},
+				cli.StringFlag{Name: "prefix", Usage: "only export the keys with this prefix"},
+				cli.IntFlag{Name: "concurrency", Value: 8, Usage: "number of concurrent adds"},
+				cli.StringFlag{Name: "manifest", Usage: "key to CID manifest file " +
+					"(default ipfsexport-<unix time>.txt)"},
+			},
 			Action: cmd.WithCfg(func(c *cli.Context, cfg *config.Config) error {
-				return cmd.CmdDbIPFSexport(c, cfg.Storage.Path)
+				return cmd.CmdDbIPFSexport(c, &cfg.Storage, &cfg.Ipfs)
 			}),
 		},
 	},
@@ -0,0 +1,32 @@
+package commands
+
+import (
+	"github.com/iden3/go-iden3-servers/cmd"
+	"github.com/urfave/cli"
+)
+
+var IdentityCommands = []cli.Command{{
+	Name:  "identity",
+	Usage: "move the identity between deployments",
+	Subcommands: []cli.Command{
+		{
+			Name:      "export",
+			Usage:     "write the identity data, babyjub key and config to an encrypted archive",
+			ArgsUsage: "<file>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "password", Usage: "archive password, 'password://' or 'file://' prefixed"},
+				cli.StringFlag{Name: "id", Usage: "hosted identity to export, the main one by default"},
+			},
+			Action: cmd.CmdIdentityExport,
+		},
+		{
+			Name:      "import",
+			Usage:     "import the identity of an encrypted archive into the storage and babyjub keystore",
+			ArgsUsage: "<file>",
+			Flags: []cli.Flag{
+				cli.StringFlag{Name: "password", Usage: "archive password, 'password://' or 'file://' prefixed"},
+			},
+			Action: cmd.CmdIdentityImport,
+		},
+	},
+}}
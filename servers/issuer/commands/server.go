@@ -19,6 +19,9 @@ var ServerCommands = []cli.Command{
 		Name:    "start",
 		Aliases: []string{},
 		Usage:   "start the server",
+		Flags: []cli.Flag{
+			cli.BoolFlag{Name: "migrate", Usage: "migrate the database before starting"},
+		},
 		Action: cmd.WithCfg(func(c *cli.Context, cfg *config.Config) error {
 			return cmd.CmdStart(c, cfg, endpoint.Serve)
 		}),
@@ -27,7 +30,10 @@ var ServerCommands = []cli.Command{
 		Name:    "sync",
 		Aliases: []string{},
 		Usage:   "sync the identity state with the smart contract",
-		Action:  cmd.WithCfg(cmd.CmdSync),
+		Flags: []cli.Flag{
+			cli.StringFlag{Name: "id", Usage: "hosted identity to sync (default the main one)"},
+		},
+		Action: cmd.WithCfg(cmd.CmdSync),
 	},
 	// {
 	// 	Name:    "stop",
@@ -1,9 +1,14 @@
 package endpoint
 
 import (
+	"fmt"
+	"net/http"
+
 	"github.com/gin-gonic/gin"
+	"github.com/iden3/go-iden3-servers/config"
 	"github.com/iden3/go-iden3-servers/handlers"
 	"github.com/iden3/go-iden3-servers/loaders"
+	log "github.com/sirupsen/logrus"
 	// "errors"
 	// "net/http"
 	// "github.com/gin-gonic/gin"
@@ -16,14 +21,100 @@ type addClaimBasicMsg struct {
 	Data      string
 }
 
-func handleSyncIdenStatePublic(c *gin.Context, srv *loaders.Server) {
-	if err := srv.Issuer.SyncIdenStatePublic(); err != nil {
+func handleSyncIdenStatePublic(c *gin.Context, srv *loaders.Server, iden *loaders.Identity) {
+	if err := iden.WithLoopsPaused(iden.Issuer.SyncIdenStatePublic); err != nil {
 		handlers.Fail(c, "SyncIdenStatePublic", err)
 		return
 	}
 	c.JSON(200, gin.H{})
 }
 
+func handleCancelProof(c *gin.Context, srv *loaders.Server, iden *loaders.Identity) {
+	if !srv.Prover.Cancel(iden.Issuer.ID()) {
+		c.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("No proof job of identity %v", iden.Issuer.ID()),
+		})
+		return
+	}
+	c.JSON(200, gin.H{})
+}
+
+func handlePostBackup(c *gin.Context, srv *loaders.Server) {
+	snapshot, manifest, err := srv.Snapshot()
+	if err != nil {
+		handlers.Fail(c, "Snapshot", err)
+		return
+	}
+	defer snapshot.Close()
+	c.Header("Content-Type", "application/gzip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%v", manifest.FileName()))
+	c.Status(http.StatusOK)
+	if err := snapshot.WriteArchive(c.Writer, manifest); err != nil {
+		log.WithError(err).Error("Error writing backup archive")
+		return
+	}
+	log.WithField("keys", manifest.Keys).WithField("state", manifest.State).Info("Backup sent")
+}
+
+func handleGetInfo(c *gin.Context, srv *loaders.Server, iden *loaders.Identity) {
+	state, _ := iden.Issuer.State()
+	pending, transacted := iden.Issuer.IdenStatePending()
+	c.JSON(http.StatusOK, gin.H{
+		"id":                iden.Issuer.ID(),
+		"state":             state,
+		"onchain":           iden.Issuer.StateDataOnChain(),
+		"pending":           pending,
+		"pendingTransacted": transacted,
+		"account": gin.H{
+			"address": srv.EthClient.Account().Address,
+			"funds":   srv.Funds(),
+		},
+		"web3": srv.Web3Pool.Status(),
+	})
+}
+
+func handleGetIdentities(c *gin.Context, srv *loaders.Server) {
+	idens := srv.Identities()
+	identities := make([]gin.H, len(idens))
+	for i, iden := range idens {
+		state, _ := iden.Issuer.State()
+		pending, _ := iden.Issuer.IdenStatePending()
+		identities[i] = gin.H{
+			"id":      iden.Issuer.ID(),
+			"state":   state,
+			"pending": pending,
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"identities": identities})
+}
+
+func handlePostIdentities(c *gin.Context, srv *loaders.Server) {
+	iden, err := srv.CreateIdentity()
+	if err != nil {
+		handlers.Fail(c, "CreateIdentity", err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"id":  iden.Issuer.ID(),
+		"kOp": iden.Cfg.Keys.BabyJub.KOp.Compress(),
+	})
+}
+
+func handleGetConfig(c *gin.Context, srv *loaders.Server) {
+	cfg := srv.Cfg.Redacted()
+	format := c.DefaultQuery("format", config.FormatJSON)
+	if format == config.FormatJSON {
+		c.JSON(http.StatusOK, cfg)
+		return
+	}
+	cfgOut, err := config.Marshal(cfg, format)
+	if err != nil {
+		handlers.Fail(c, "config.Marshal", err)
+		return
+	}
+	c.Data(http.StatusOK, "application/toml", cfgOut)
+}
+
 // DEPRECATED
 // func handleAddClaimBasic(c *gin.Context) {
 // 	var m addClaimBasicMsg
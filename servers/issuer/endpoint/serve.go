@@ -43,7 +43,18 @@ func serveAdminApi(addr string, stopch chan interface{}, srv *loaders.Server) *h
 	}
 	// DEPRECATED
 	// adminapi.POST("/claims/basic", serve.WithServer(srv, handleAddClaimBasic))
-	adminapi.POST("/issuer/syncidenstatepublic", serve.WithServer(srv, handleSyncIdenStatePublic))
+	adminapi.POST("/issuer/syncidenstatepublic", serve.WithIdentity(srv, handleSyncIdenStatePublic))
+	adminapi.POST("/issuer/cancelproof", serve.WithIdentity(srv, handleCancelProof))
+	adminapi.GET("/config", serve.WithServer(srv, handleGetConfig))
+	adminapi.GET("/info", serve.WithIdentity(srv, handleGetInfo))
+	adminapi.POST("/backup", serve.WithServer(srv, handlePostBackup))
+	adminapi.GET("/identities", serve.WithServer(srv, handleGetIdentities))
+	adminapi.POST("/identities", serve.WithServer(srv, handlePostIdentities))
+
+	idenapi := adminapi.Group("/identities/:id")
+	idenapi.POST("/issuer/syncidenstatepublic", serve.WithIdentity(srv, handleSyncIdenStatePublic))
+	idenapi.POST("/issuer/cancelproof", serve.WithIdentity(srv, handleCancelProof))
+	idenapi.GET("/info", serve.WithIdentity(srv, handleGetInfo))
 
 	adminapisrv := &http.Server{Addr: addr, Handler: api}
 	go func() {
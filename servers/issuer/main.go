@@ -21,7 +21,9 @@ func main() {
 	app.Commands = []cli.Command{}
 	app.Commands = append(app.Commands, commands.ServerCommands...)
 	app.Commands = append(app.Commands, commands.DbCommands...)
+	app.Commands = append(app.Commands, commands.IdentityCommands...)
 	app.Commands = append(app.Commands, commands.ClaimCommands...)
+	app.Commands = append(app.Commands, commands.ConfigCommands...)
 
 	err := app.Run(os.Args)
 	if err != nil {
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/iden3/go-iden3-core/db"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+var boltBucket = []byte("iden3")
+
+// BoltStorage is a db.Storage backed by a bbolt database file.  All the key
+// values are stored in a single bucket.
+type BoltStorage struct {
+	bdb    *bolt.DB
+	prefix []byte
+}
+
+// BoltStorageTx is a db.Tx of BoltStorage.  The writes are cached and written
+// in a single bolt transaction by Commit.
+type BoltStorageTx struct {
+	*BoltStorage
+	cache map[string][]byte
+}
+
+// NewBoltStorage opens the bolt database at path, creating it if it doesn't
+// exist.
+func NewBoltStorage(path string, readOnly bool) (*BoltStorage, error) {
+	bdb, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 1 * time.Second, ReadOnly: readOnly})
+	if err == bolt.ErrTimeout {
+		return nil, ErrLocked
+	} else if err != nil {
+		return nil, err
+	}
+	if !readOnly {
+		if err := bdb.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltBucket)
+			return err
+		}); err != nil {
+			bdb.Close()
+			return nil, err
+		}
+	}
+	return &BoltStorage{bdb, []byte{}}, nil
+}
+
+func (b *BoltStorage) Info() string {
+	keyCount := 0
+	if err := b.Iterate(func(k, v []byte) (bool, error) {
+		keyCount++
+		return true, nil
+	}); err != nil {
+		return err.Error()
+	}
+	json, _ := json.MarshalIndent(struct{ KeyCount int }{keyCount}, "", "  ")
+	return string(json)
+}
+
+func (b *BoltStorage) WithPrefix(prefix []byte) db.Storage {
+	return &BoltStorage{b.bdb, concat(b.prefix, prefix)}
+}
+
+func (b *BoltStorage) NewTx() (db.Tx, error) {
+	return &BoltStorageTx{b, make(map[string][]byte)}, nil
+}
+
+func (b *BoltStorage) get(key []byte) ([]byte, error) {
+	var value []byte
+	if err := b.bdb.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if bucket == nil {
+			return db.ErrNotFound
+		}
+		v := bucket.Get(key)
+		if v == nil {
+			return db.ErrNotFound
+		}
+		value = clone(v)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (b *BoltStorage) Get(key []byte) ([]byte, error) {
+	return b.get(concat(b.prefix, key))
+}
+
+// Iterate calls f with the key values under the storage prefix in key order.
+// All the key values are read in a single bolt read transaction, so they are
+// a consistent view of the storage.  f must not commit transactions of the
+// storage from the same goroutine, as bolt may need to wait for the read
+// transaction to finish to grow the database file.
+func (b *BoltStorage) Iterate(f func([]byte, []byte) (bool, error)) error {
+	return b.bdb.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if bucket == nil {
+			return nil
+		}
+		c := bucket.Cursor()
+		for k, v := c.Seek(b.prefix); k != nil && bytes.HasPrefix(k, b.prefix); k, v = c.Next() {
+			if cont, err := f(clone(k[len(b.prefix):]), clone(v)); err != nil {
+				return err
+			} else if !cont {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BoltStorage) List(limit int) ([]db.KV, error) {
+	ret := []db.KV{}
+	err := b.Iterate(func(key []byte, value []byte) (bool, error) {
+		ret = append(ret, db.KV{K: key, V: value})
+		if len(ret) == limit {
+			return false, nil
+		}
+		return true, nil
+	})
+	return ret, err
+}
+
+func (b *BoltStorage) Close() {
+	if err := b.bdb.Close(); err != nil {
+		panic(err)
+	}
+	log.Info("Database closed")
+}
+
+// Bolt returns the underlying bolt database.
+func (b *BoltStorage) Bolt() *bolt.DB {
+	return b.bdb
+}
+
+func (tx *BoltStorageTx) Get(key []byte) ([]byte, error) {
+	fullKey := concat(tx.prefix, key)
+	if value, ok := tx.cache[string(fullKey)]; ok {
+		return value, nil
+	}
+	return tx.get(fullKey)
+}
+
+func (tx *BoltStorageTx) Put(k, v []byte) {
+	tx.cache[string(concat(tx.prefix, k))] = v
+}
+
+func (tx *BoltStorageTx) Add(atx db.Tx) {
+	for k, v := range atx.(*BoltStorageTx).cache {
+		tx.cache[k] = v
+	}
+}
+
+func (tx *BoltStorageTx) Commit() error {
+	cache := tx.cache
+	tx.cache = nil
+	return tx.bdb.Update(func(btx *bolt.Tx) error {
+		bucket := btx.Bucket(boltBucket)
+		for k, v := range cache {
+			if err := bucket.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (tx *BoltStorageTx) Close() {
+	tx.cache = nil
+}
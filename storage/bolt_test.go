@@ -0,0 +1,90 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/db"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "boltstorage")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "storage.db")
+
+	storage, err := NewBoltStorage(path, false)
+	require.Nil(t, err)
+	sto1 := storage.WithPrefix([]byte("a:"))
+	sto2 := storage.WithPrefix([]byte("b:"))
+
+	n := 2058
+	tx, err := sto1.NewTx()
+	require.Nil(t, err)
+	for i := 0; i < n; i++ {
+		tx.Put([]byte(fmt.Sprintf("%06d", i)), []byte{byte(i)})
+	}
+	v, err := tx.Get([]byte("000001"))
+	require.Nil(t, err)
+	require.Equal(t, []byte{1}, v)
+	_, err = sto1.Get([]byte("000001"))
+	require.Equal(t, db.ErrNotFound, err)
+	require.Nil(t, tx.Commit())
+
+	tx, err = sto2.NewTx()
+	require.Nil(t, err)
+	tx.Put([]byte("000001"), []byte("b"))
+	require.Nil(t, tx.Commit())
+
+	v, err = sto1.Get([]byte("000001"))
+	require.Nil(t, err)
+	require.Equal(t, []byte{1}, v)
+	v, err = sto2.Get([]byte("000001"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("b"), v)
+
+	i := 0
+	require.Nil(t, sto1.Iterate(func(k, v []byte) (bool, error) {
+		require.Equal(t, []byte(fmt.Sprintf("%06d", i)), k)
+		i++
+		return true, nil
+	}))
+	require.Equal(t, n, i)
+
+	// The iteration doesn't see the writes committed while it runs
+	i = 0
+	committed := make(chan error)
+	require.Nil(t, sto1.Iterate(func(k, v []byte) (bool, error) {
+		if i == 0 {
+			go func() {
+				tx, err := sto1.NewTx()
+				require.Nil(t, err)
+				tx.Put([]byte("999999"), []byte{0})
+				committed <- tx.Commit()
+			}()
+			require.Nil(t, <-committed)
+		}
+		i++
+		return true, nil
+	}))
+	require.Equal(t, n, i)
+	_, err = sto1.Get([]byte("999999"))
+	require.Nil(t, err)
+
+	kvs, err := storage.List(3)
+	require.Nil(t, err)
+	require.Equal(t, 3, len(kvs))
+	require.Equal(t, []byte("a:000000"), kvs[0].K)
+	storage.Close()
+
+	storage, err = NewBoltStorage(path, true)
+	require.Nil(t, err)
+	defer storage.Close()
+	kvs, err = storage.WithPrefix([]byte("b:")).List(0)
+	require.Nil(t, err)
+	require.Equal(t, []db.KV{{K: []byte("000001"), V: []byte("b")}}, kvs)
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"syscall"
+
+	"github.com/iden3/go-iden3-core/db"
+	log "github.com/sirupsen/logrus"
+	"github.com/syndtr/goleveldb/leveldb"
+	lerrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	lstorage "github.com/syndtr/goleveldb/leveldb/storage"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LevelDbStorage is a db.Storage backed by leveldb that, unlike
+// db.LevelDbStorage, can be opened with custom options.  Both use the same
+// layout, so they can open the same databases.
+type LevelDbStorage struct {
+	ldb    *leveldb.DB
+	prefix []byte
+}
+
+// LevelDbStorageTx is a db.Tx of LevelDbStorage.
+type LevelDbStorageTx struct {
+	*LevelDbStorage
+	cache map[string][]byte
+}
+
+// NewLevelDbStorage opens the leveldb database at path with the options o.
+// If the database is opened by another process, ErrLocked is returned.
+func NewLevelDbStorage(path string, o *opt.Options) (*LevelDbStorage, error) {
+	ldb, err := leveldb.OpenFile(path, o)
+	if err == lstorage.ErrLocked || errors.Is(err, syscall.EWOULDBLOCK) ||
+		errors.Is(err, syscall.EAGAIN) {
+		return nil, ErrLocked
+	} else if err != nil {
+		return nil, err
+	}
+	return &LevelDbStorage{ldb, []byte{}}, nil
+}
+
+func (l *LevelDbStorage) Info() string {
+	keyCount := 0
+	if err := l.Iterate(func(k, v []byte) (bool, error) {
+		keyCount++
+		return true, nil
+	}); err != nil {
+		return err.Error()
+	}
+	json, _ := json.MarshalIndent(struct{ KeyCount int }{keyCount}, "", "  ")
+	return string(json)
+}
+
+func (l *LevelDbStorage) WithPrefix(prefix []byte) db.Storage {
+	return &LevelDbStorage{l.ldb, concat(l.prefix, prefix)}
+}
+
+func (l *LevelDbStorage) NewTx() (db.Tx, error) {
+	return &LevelDbStorageTx{l, make(map[string][]byte)}, nil
+}
+
+func (l *LevelDbStorage) get(key []byte) ([]byte, error) {
+	v, err := l.ldb.Get(key, nil)
+	if err == lerrors.ErrNotFound {
+		return nil, db.ErrNotFound
+	}
+	return v, err
+}
+
+func (l *LevelDbStorage) Get(key []byte) ([]byte, error) {
+	return l.get(concat(l.prefix, key))
+}
+
+// Iterate calls f with the key values under the storage prefix in key order,
+// from a snapshot of the database.
+func (l *LevelDbStorage) Iterate(f func([]byte, []byte) (bool, error)) error {
+	snapshot, err := l.ldb.GetSnapshot()
+	if err != nil {
+		return err
+	}
+	defer snapshot.Release()
+	iter := snapshot.NewIterator(util.BytesPrefix(l.prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		if cont, err := f(clone(iter.Key()[len(l.prefix):]), clone(iter.Value())); err != nil {
+			return err
+		} else if !cont {
+			break
+		}
+	}
+	return iter.Error()
+}
+
+func (l *LevelDbStorage) List(limit int) ([]db.KV, error) {
+	ret := []db.KV{}
+	err := l.Iterate(func(key []byte, value []byte) (bool, error) {
+		ret = append(ret, db.KV{K: key, V: value})
+		if len(ret) == limit {
+			return false, nil
+		}
+		return true, nil
+	})
+	return ret, err
+}
+
+func (l *LevelDbStorage) Close() {
+	if err := l.ldb.Close(); err != nil {
+		panic(err)
+	}
+	log.Info("Database closed")
+}
+
+// LevelDB returns the underlying leveldb database.
+func (l *LevelDbStorage) LevelDB() *leveldb.DB {
+	return l.ldb
+}
+
+func (tx *LevelDbStorageTx) Get(key []byte) ([]byte, error) {
+	fullKey := concat(tx.prefix, key)
+	if value, ok := tx.cache[string(fullKey)]; ok {
+		return value, nil
+	}
+	return tx.get(fullKey)
+}
+
+func (tx *LevelDbStorageTx) Put(k, v []byte) {
+	tx.cache[string(concat(tx.prefix, k))] = v
+}
+
+func (tx *LevelDbStorageTx) Add(atx db.Tx) {
+	for k, v := range atx.(*LevelDbStorageTx).cache {
+		tx.cache[k] = v
+	}
+}
+
+func (tx *LevelDbStorageTx) Commit() error {
+	var batch leveldb.Batch
+	for k, v := range tx.cache {
+		batch.Put([]byte(k), v)
+	}
+	tx.cache = nil
+	return tx.ldb.Write(&batch, nil)
+}
+
+func (tx *LevelDbStorageTx) Close() {
+	tx.cache = nil
+}
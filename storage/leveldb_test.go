@@ -0,0 +1,38 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+)
+
+func TestLevelDbStorageReadOnly(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leveldbstorage")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	storage, err := NewLevelDbStorage(dir, &opt.Options{})
+	require.Nil(t, err)
+	tx, err := storage.WithPrefix([]byte("a:")).NewTx()
+	require.Nil(t, err)
+	tx.Put([]byte("k"), []byte("v"))
+	require.Nil(t, tx.Commit())
+
+	_, err = NewLevelDbStorage(dir, &opt.Options{ReadOnly: true})
+	require.Equal(t, ErrLocked, err)
+	storage.Close()
+
+	storage, err = NewLevelDbStorage(dir, &opt.Options{ReadOnly: true})
+	require.Nil(t, err)
+	defer storage.Close()
+	v, err := storage.Get([]byte("a:k"))
+	require.Nil(t, err)
+	require.Equal(t, []byte("v"), v)
+	tx, err = storage.NewTx()
+	require.Nil(t, err)
+	tx.Put([]byte("k"), []byte("v"))
+	require.NotNil(t, tx.Commit())
+}
@@ -0,0 +1,19 @@
+// Package storage contains db.Storage implementations that complement the
+// ones of go-iden3-core.
+package storage
+
+import "errors"
+
+// ErrLocked is returned when the storage is opened by another process.
+var ErrLocked = errors.New("storage locked by running server")
+
+func concat(a, b []byte) []byte {
+	c := make([]byte, len(a)+len(b))
+	copy(c, a)
+	copy(c[len(a):], b)
+	return c
+}
+
+func clone(b []byte) []byte {
+	return append([]byte{}, b...)
+}
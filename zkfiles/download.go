@@ -0,0 +1,329 @@
+package zkfiles
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gofrs/flock"
+	log "github.com/sirupsen/logrus"
+)
+
+// attemptsDefault is the number of rounds over the sources used when
+// Downloader.Attempts is not set.
+const attemptsDefault = 3
+
+// Progress is the progress of the download of a file.  Total is -1 when
+// the size is unknown.
+type Progress struct {
+	Name   string
+	Source string
+	Done   int64
+	Total  int64
+}
+
+// Downloader downloads the zk files from the first source that has them.
+// A source is the base url of the files, http(s):// or file://.  The
+// sources are tried in order up to Attempts times, resuming the partial
+// download of the previous tries if the file has a hash.  Every file is downloaded into a .part
+// file that is only renamed into place after its hash is verified.
+type Downloader struct {
+	Sources  []string
+	Attempts int
+	Client   *http.Client
+	// Progress is called after every write to a file, if not nil.
+	Progress func(p *Progress)
+	// RetryDelay is the wait between the rounds over the sources.
+	RetryDelay time.Duration
+	// AllowUnverified allows files without hash, which are downloaded
+	// without verification and kept if they exist.
+	AllowUnverified bool
+}
+
+// NewDownloader creates a Downloader from the sources with the default
+// http client.
+func NewDownloader(sources ...string) *Downloader {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	return &Downloader{
+		Sources:  sources,
+		Attempts: attemptsDefault,
+		Client: &http.Client{Transport: &http.Transport{
+			Proxy:                 http.ProxyFromEnvironment,
+			DialContext:           dialer.DialContext,
+			ResponseHeaderTimeout: 30 * time.Second,
+		}},
+		RetryDelay: 2 * time.Second,
+	}
+}
+
+// Download downloads the files into dir.  The files already in dir that
+// match their hash are kept.  A file without hash is an error unless
+// AllowUnverified is set.
+func (d *Downloader) Download(dir string, files []File) error {
+	if !d.AllowUnverified {
+		for _, file := range files {
+			if file.Hash == "" {
+				return fmt.Errorf("No expected hash for ZkFile %v", file.Name)
+			}
+		}
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := d.downloadFile(dir, file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exists returns true if the file is in place, and matches its hash if it
+// has one.  Files without hash are only allowed by Download with
+// AllowUnverified.
+func exists(path string, file File) (bool, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if file.Hash == "" {
+		return true, nil
+	}
+	hash, err := HashFile(path)
+	if err != nil {
+		return false, err
+	}
+	if hash != strings.ToLower(file.Hash) {
+		log.WithField("file", path).WithField("hash", hash).Warn("ZkFile hash mismatch, downloading it again")
+		return false, nil
+	}
+	return true, nil
+}
+
+func (d *Downloader) downloadFile(dir string, file File) error {
+	path := filepath.Join(dir, file.Name)
+	if ok, err := exists(path, file); err != nil || ok {
+		return err
+	}
+	partPath := path + ".part"
+	lock := flock.New(partPath + ".lock")
+	if err := lock.Lock(); err != nil {
+		return err
+	}
+	// The lock file is never removed: a process waiting on it would
+	// otherwise get its lock on an unlinked file while another one locks a
+	// new file
+	defer lock.Unlock() //nolint:errcheck
+	// The file may have been downloaded by another process while waiting
+	// for the lock
+	if ok, err := exists(path, file); err != nil || ok {
+		return err
+	}
+	if file.Hash == "" {
+		log.WithField("file", file.Name).Warn("Downloading ZkFile without hash, it won't be verified")
+	}
+	if len(d.Sources) == 0 {
+		return fmt.Errorf("ZkFile %v not found and no download source configured", path)
+	}
+
+	attempts := d.Attempts
+	if attempts <= 0 {
+		attempts = attemptsDefault
+	}
+	var errs []string
+	for attempt := 0; attempt < attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(d.RetryDelay)
+		}
+		for _, source := range d.Sources {
+			logger := log.WithField("file", file.Name).WithField("source", redact(source))
+			// Without hash, a stale or oversized partial download can't be
+			// told from a complete one, so it's not resumed
+			if file.Hash == "" {
+				if err := os.Remove(partPath); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+			err := d.fetch(partPath, source, file.Name)
+			if err == nil {
+				err = verify(partPath, file)
+			}
+			if err != nil {
+				logger.WithField("err", err).Warn("Error downloading ZkFile")
+				errs = append(errs, fmt.Sprintf("%v: %v", redact(source), err))
+				continue
+			}
+			if err := os.Rename(partPath, path); err != nil {
+				return err
+			}
+			logger.Info("ZkFile downloaded")
+			return nil
+		}
+	}
+	return fmt.Errorf("Error downloading ZkFile %v: %v", file.Name, strings.Join(errs, "; "))
+}
+
+// verify checks the hash of the complete download at partPath, removing it
+// on mismatch so that the next try starts from scratch.
+func verify(partPath string, file File) error {
+	if file.Hash == "" {
+		return nil
+	}
+	hash, err := HashFile(partPath)
+	if err != nil {
+		return err
+	}
+	if hash != strings.ToLower(file.Hash) {
+		if err := os.Remove(partPath); err != nil {
+			return err
+		}
+		return fmt.Errorf("Hash mismatch: expected %v but got %v", file.Hash, hash)
+	}
+	return nil
+}
+
+// redact removes the user info, query and fragment of the source, which
+// may contain credentials.
+func redact(source string) string {
+	u, err := url.Parse(source)
+	if err != nil {
+		return "(invalid)"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	u.Fragment = ""
+	return u.String()
+}
+
+// fetch appends the file name of source to the partial download at
+// partPath, until it's complete.
+func (d *Downloader) fetch(partPath, source, name string) error {
+	part, err := os.OpenFile(partPath, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer part.Close()
+	offset, err := part.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(source, "/") + "/" + name)
+	if err != nil {
+		return err
+	}
+	var body io.ReadCloser
+	total := int64(-1)
+	switch u.Scheme {
+	case "file":
+		f, err := os.Open(u.Path)
+		if err != nil {
+			return err
+		}
+		if info, err := f.Stat(); err == nil {
+			total = info.Size()
+		}
+		if offset > total {
+			offset = 0
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			f.Close()
+			return err
+		}
+		body = f
+	case "http", "https":
+		req, err := http.NewRequest("GET", u.String(), nil)
+		if err != nil {
+			return err
+		}
+		if offset > 0 {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		}
+		resp, err := d.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		switch {
+		case resp.StatusCode == http.StatusPartialContent &&
+			strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)):
+			if resp.ContentLength >= 0 {
+				total = offset + resp.ContentLength
+			}
+		case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+			// The partial download is complete, or bigger than the file,
+			// which the hash verification will find out
+			resp.Body.Close()
+			return nil
+		case resp.StatusCode == http.StatusOK:
+			// The server doesn't support ranges: start from scratch
+			offset = 0
+			total = resp.ContentLength
+		default:
+			resp.Body.Close()
+			return fmt.Errorf("HTTP Status: %v", resp.Status)
+		}
+		body = resp.Body
+	default:
+		return fmt.Errorf("Unsupported source scheme %q", u.Scheme)
+	}
+	defer body.Close()
+
+	if err := part.Truncate(offset); err != nil {
+		return err
+	}
+	if _, err := part.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	progress := &Progress{Name: name, Source: redact(source), Done: offset, Total: total}
+	buf := make([]byte, 256*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			if _, err := part.Write(buf[:n]); err != nil {
+				return err
+			}
+			progress.Done += int64(n)
+			if d.Progress != nil {
+				d.Progress(progress)
+			}
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	if total >= 0 && progress.Done != total {
+		return fmt.Errorf("Incomplete download: %v of %v bytes", progress.Done, total)
+	}
+	if err := part.Sync(); err != nil {
+		return err
+	}
+	return part.Close()
+}
+
+// LogProgress returns a Downloader.Progress that logs the progress of every
+// file at most once per interval, and when it's complete.
+func LogProgress(interval time.Duration) func(p *Progress) {
+	var last time.Time
+	return func(p *Progress) {
+		if time.Since(last) < interval && p.Done != p.Total {
+			return
+		}
+		last = time.Now()
+		logger := log.WithField("file", p.Name).WithField("source", p.Source).
+			WithField("bytes", p.Done)
+		if p.Total > 0 {
+			logger = logger.WithField("total", p.Total).
+				WithField("percent", fmt.Sprintf("%.1f", float64(p.Done)*100/float64(p.Total)))
+		}
+		logger.Info("Downloading ZkFile")
+	}
+}
@@ -0,0 +1,208 @@
+package zkfiles
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func hashBytes(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+// flakyServer serves content, cutting every response after limit bytes, and
+// records the Range headers of the requests.
+type flakyServer struct {
+	mutex   sync.Mutex
+	content []byte
+	limit   int
+	ranges  []string
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	s.ranges = append(s.ranges, r.Header.Get("Range"))
+	s.mutex.Unlock()
+	start := 0
+	if rng := r.Header.Get("Range"); rng != "" {
+		fmt.Sscanf(rng, "bytes=%d-", &start)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(s.content)-1, len(s.content)))
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.content)-start))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(len(s.content)))
+	}
+	end := start + s.limit
+	if end > len(s.content) {
+		end = len(s.content)
+	}
+	w.Write(s.content[start:end]) //nolint:errcheck
+}
+
+func testDownloader(sources ...string) *Downloader {
+	d := NewDownloader(sources...)
+	d.RetryDelay = time.Millisecond
+	return d
+}
+
+func TestDownloadResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkfiles")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	content := bytes.Repeat([]byte("0123456789"), 100000)
+	flaky := &flakyServer{content: content, limit: 300000}
+	server := httptest.NewServer(flaky)
+	defer server.Close()
+
+	d := testDownloader(server.URL)
+	d.Attempts = 4
+	var progress []int64
+	d.Progress = func(p *Progress) { progress = append(progress, p.Done) }
+	files := []File{{Name: "proving_key.json", Hash: hashBytes(content)}}
+	require.Nil(t, d.Download(dir, files))
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "proving_key.json"))
+	require.Nil(t, err)
+	require.Equal(t, content, data)
+	require.Equal(t, []string{"", "bytes=300000-", "bytes=600000-", "bytes=900000-"}, flaky.ranges)
+	require.Equal(t, int64(len(content)), progress[len(progress)-1])
+	_, err = os.Stat(filepath.Join(dir, "proving_key.json.part"))
+	require.True(t, os.IsNotExist(err))
+
+	// The verified file is kept
+	require.Nil(t, d.Download(dir, files))
+	require.Equal(t, 4, len(flaky.ranges))
+}
+
+func TestDownloadMirrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkfiles")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	content := []byte("verification key")
+	bad := httptest.NewServer(&flakyServer{content: []byte("tampered key"), limit: 100})
+	defer bad.Close()
+	notFound := httptest.NewServer(http.NotFoundHandler())
+	defer notFound.Close()
+
+	mirror := filepath.Join(dir, "mirror")
+	require.Nil(t, os.Mkdir(mirror, 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(mirror, "verification_key.json"), content, 0600))
+
+	dst := filepath.Join(dir, "dst")
+	files := []File{{Name: "verification_key.json", Hash: hashBytes(content)}}
+	d := testDownloader(notFound.URL, bad.URL, "file://"+mirror)
+	require.Nil(t, d.Download(dst, files))
+	data, err := ioutil.ReadFile(filepath.Join(dst, "verification_key.json"))
+	require.Nil(t, err)
+	require.Equal(t, content, data)
+
+	// No source has the file
+	require.Nil(t, os.Remove(filepath.Join(dst, "verification_key.json")))
+	d = testDownloader(notFound.URL, bad.URL)
+	d.Attempts = 1
+	err = d.Download(dst, files)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "404")
+	require.Contains(t, err.Error(), "Hash mismatch")
+	_, err = os.Stat(filepath.Join(dst, "verification_key.json"))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestDownloadFileResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkfiles")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	content := []byte("witness calculator wasm")
+	mirror := filepath.Join(dir, "mirror")
+	require.Nil(t, os.Mkdir(mirror, 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(mirror, "circuit.wasm"), content, 0600))
+	dst := filepath.Join(dir, "dst")
+	require.Nil(t, os.Mkdir(dst, 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dst, "circuit.wasm.part"), content[:7], 0600))
+
+	var first int64 = -1
+	d := testDownloader("file://" + mirror)
+	d.Progress = func(p *Progress) {
+		if first == -1 {
+			first = p.Done
+		}
+	}
+	require.Nil(t, d.Download(dst, []File{{Name: "circuit.wasm", Hash: hashBytes(content)}}))
+	data, err := ioutil.ReadFile(filepath.Join(dst, "circuit.wasm"))
+	require.Nil(t, err)
+	require.Equal(t, content, data)
+	require.Equal(t, int64(len(content)), first)
+}
+
+func TestDownloadUnverified(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkfiles")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	content := []byte("proving key")
+	mirror := filepath.Join(dir, "mirror")
+	require.Nil(t, os.Mkdir(mirror, 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(mirror, "proving_key.json"), content, 0600))
+	dst := filepath.Join(dir, "dst")
+	files := []File{{Name: "proving_key.json"}}
+
+	// A missing hash is an error, even if the file exists
+	d := testDownloader("file://" + mirror)
+	err = d.Download(dst, files)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "No expected hash")
+	_, err = os.Stat(filepath.Join(dst, "proving_key.json"))
+	require.True(t, os.IsNotExist(err))
+	require.Nil(t, os.Mkdir(dst, 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dst, "proving_key.json"), []byte("tampered key"), 0600))
+	require.NotNil(t, d.Download(dst, files))
+
+	// Unless it's explicitly allowed
+	require.Nil(t, os.Remove(filepath.Join(dst, "proving_key.json")))
+	d.AllowUnverified = true
+	require.Nil(t, d.Download(dst, files))
+	data, err := ioutil.ReadFile(filepath.Join(dst, "proving_key.json"))
+	require.Nil(t, err)
+	require.Equal(t, content, data)
+}
+
+func TestDownloadUnverifiedNoResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkfiles")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	content := []byte("proving key")
+	mirror := filepath.Join(dir, "mirror")
+	require.Nil(t, os.Mkdir(mirror, 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(mirror, "proving_key.json"), content, 0600))
+	// A stale partial download as big as the file
+	dst := filepath.Join(dir, "dst")
+	require.Nil(t, os.Mkdir(dst, 0700))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dst, "proving_key.json.part"),
+		bytes.Repeat([]byte{'x'}, len(content)), 0600))
+
+	d := testDownloader("file://" + mirror)
+	d.AllowUnverified = true
+	require.Nil(t, d.Download(dst, []File{{Name: "proving_key.json"}}))
+	data, err := ioutil.ReadFile(filepath.Join(dst, "proving_key.json"))
+	require.Nil(t, err)
+	require.Equal(t, content, data)
+	_, err = os.Stat(filepath.Join(dst, "proving_key.json.part.lock"))
+	require.Nil(t, err)
+}
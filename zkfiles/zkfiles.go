@@ -0,0 +1,92 @@
+// Package zkfiles verifies the zk files of a circuit: the proving key, the
+// verification key and the witness calculator, identified by the sha256 of
+// their contents.
+package zkfiles
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	zkutils "github.com/iden3/go-iden3-core/utils/zk"
+)
+
+// File is a zk file with the expected sha256 in hex of its contents.
+type File struct {
+	Name string
+	Hash string
+}
+
+// Files returns the zk files of the proving key format with their expected
+// hashes.  The names are the ones used by zkutils.ZkFiles.
+func Files(format zkutils.ProvingKeyFormat, hashes *zkutils.ZkFilesHashes) []File {
+	return []File{
+		{Name: fmt.Sprintf("proving_key.%v", format), Hash: hashes.ProvingKey},
+		{Name: "verification_key.json", Hash: hashes.VerificationKey},
+		{Name: "circuit.wasm", Hash: hashes.WitnessCalcWASM},
+	}
+}
+
+// HashFile returns the sha256 in hex of the contents of the file.
+func HashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Result is the result of checking a zk file.  Actual is the sha256 of the
+// local file, empty if it can't be read.
+type Result struct {
+	File
+	Path   string
+	Actual string
+	Err    error
+}
+
+// Ok returns true if the local file matches the expected hash.
+func (r *Result) Ok() bool {
+	return r.Err == nil
+}
+
+func (r *Result) String() string {
+	if r.Ok() {
+		return fmt.Sprintf("ok        %v %v", r.Name, r.Actual)
+	}
+	return fmt.Sprintf("FAIL      %v: %v", r.Name, r.Err)
+}
+
+// Check hashes the files in dir and compares them with the expected hashes.
+// A file without expected hash fails the check.
+func Check(dir string, files []File) []Result {
+	results := make([]Result, len(files))
+	for i, file := range files {
+		r := &results[i]
+		r.File = file
+		r.Path = filepath.Join(dir, file.Name)
+		if file.Hash == "" {
+			r.Err = fmt.Errorf("No expected hash")
+			continue
+		}
+		hash, err := HashFile(r.Path)
+		if err != nil {
+			r.Err = err
+			continue
+		}
+		r.Actual = hash
+		if hash != strings.ToLower(file.Hash) {
+			r.Err = fmt.Errorf("Hash mismatch: expected %v but got %v", file.Hash, hash)
+		}
+	}
+	return results
+}
@@ -0,0 +1,38 @@
+package zkfiles
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	zkutils "github.com/iden3/go-iden3-core/utils/zk"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheck(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zkfiles")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "proving_key.json"), []byte("a"), 0600))
+	require.Nil(t, ioutil.WriteFile(filepath.Join(dir, "verification_key.json"), []byte("b"), 0600))
+
+	hashes := &zkutils.ZkFilesHashes{
+		ProvingKey:      "CA978112CA1BBDCAFAC231B39A23DC4DA786EFF8147C4E72B9807785AFEE48BB",
+		VerificationKey: "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb",
+	}
+	results := Check(dir, Files(zkutils.ProvingKeyFormatJSON, hashes))
+	require.Equal(t, 3, len(results))
+	require.True(t, results[0].Ok())
+	require.Equal(t, "ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb", results[0].Actual)
+	require.False(t, results[1].Ok())
+	require.Contains(t, results[1].Err.Error(), "Hash mismatch")
+	require.Equal(t, "3e23e8160039594a33894f6564e1b1348bbd7a0088d42c4acb73eeaed59c009d", results[1].Actual)
+	require.False(t, results[2].Ok())
+	require.Equal(t, "circuit.wasm", results[2].Name)
+	require.Contains(t, results[2].Err.Error(), "No expected hash")
+
+	hashes.WitnessCalcWASM = hashes.ProvingKey
+	results = Check(dir, Files(zkutils.ProvingKeyFormatJSON, hashes))
+	require.True(t, os.IsNotExist(results[2].Err))
+}